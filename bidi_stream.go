@@ -0,0 +1,557 @@
+package tlb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+)
+
+//
+// StreamWindow is how many structs either end of a Stream can send
+// before the other end has read them with stream.Recv.
+//
+const StreamWindow = 64
+
+//
+// Errors returned by a Stream.  ErrStreamReset is wrapped with the
+// reason the other end gave for resetting the stream, and
+// ErrStreamOverflow is the reason a stream is reset when the other end
+// sends more than StreamWindow structs that have not been read.
+//
+var (
+	ErrStreamReset    = errors.New("stream reset")
+	ErrStreamOverflow = errors.New("stream window exceeded")
+)
+
+//
+// The kinds of StreamFrame sent on a Stream.
+//
+type StreamFrameKind int
+
+const (
+	StreamOpen StreamFrameKind = iota
+	StreamData
+	StreamHalfClose
+	StreamReset
+	StreamCredit
+)
+
+//
+// A StreamFrame carries one event on a Stream, identified by the
+// RequestID of the struct that opened it.  Opener is set on frames
+// sent by the end that opened the stream, so Peers can tell streams
+// they opened from streams opened by the other Peer.  Open and data
+// frames carry a struct, reset frames a reason, and credit frames the
+// number of structs the sender has read since its last credit frame.
+//
+type StreamFrame struct {
+	RequestID uint32
+	Kind      StreamFrameKind
+	Opener    bool
+	Type      uint16
+	Data      string
+	Credit    int
+	Message   string
+}
+
+//
+// A Stream carries a sequence of structs in each direction for one
+// logical call, opened with client.OpenStream and served by a callback
+// registered with server.AcceptStream.  Each direction is closed
+// separately with stream.CloseSend, and either end can abort the whole
+// stream with stream.Reset.
+//
+type Stream struct {
+	RequestID     uint32
+	Opener        bool
+	TypeStore     TypeStore
+	send          func(interface{}) error
+	unregister    func()
+	items         chan interface{}
+	received      chan struct{}
+	finished      chan struct{}
+	finishing     *sync.Once
+	manipulation  *sync.Mutex
+	credited      *sync.Cond
+	credit        int
+	consumed      int
+	sendClosed    bool
+	receiveClosed bool
+	discarding    bool
+	err           error
+}
+
+//
+// Create a Stream that can send credit structs before the other end
+// grants more, writing its frames with send and calling unregister
+// once it is finished.
+//
+func newStream(request_id uint32, opener bool, type_store TypeStore, credit int, send func(interface{}) error, unregister func()) *Stream {
+	manipulation := &sync.Mutex{}
+	return &Stream{
+		RequestID:    request_id,
+		Opener:       opener,
+		TypeStore:    type_store,
+		send:         send,
+		unregister:   unregister,
+		items:        make(chan interface{}, StreamWindow),
+		received:     make(chan struct{}),
+		finished:     make(chan struct{}),
+		finishing:    &sync.Once{},
+		manipulation: manipulation,
+		credited:     sync.NewCond(manipulation),
+		credit:       credit,
+	}
+}
+
+//
+// Write a frame on the stream.
+//
+func (stream *Stream) write(frame StreamFrame) error {
+	frame.RequestID = stream.RequestID
+	frame.Opener = stream.Opener
+	return stream.send(frame)
+}
+
+//
+// Send writes a struct to the other end of the stream, waiting until
+// the other end has room for it.  ErrStreamClosed is returned after
+// stream.CloseSend, and the stream's error once it has been reset or
+// its connection has closed.
+//
+func (stream *Stream) Send(instance interface{}) error {
+	struct_type, present := stream.TypeStore.LookupCode(reflect.TypeOf(instance))
+	if !present {
+		return errors.New("cannot stream type not in type store")
+	}
+	data, err := stream.TypeStore.Codec.Marshal(instance)
+	if err != nil {
+		return err
+	}
+	stream.manipulation.Lock()
+	for stream.credit == 0 && stream.err == nil && !stream.sendClosed {
+		stream.credited.Wait()
+	}
+	if stream.err != nil {
+		err = stream.err
+	} else if stream.sendClosed {
+		err = ErrStreamClosed
+	} else {
+		stream.credit -= 1
+	}
+	stream.manipulation.Unlock()
+	if err != nil {
+		return err
+	}
+	return stream.write(StreamFrame{
+		Kind: StreamData,
+		Type: struct_type,
+		Data: string(data),
+	})
+}
+
+//
+// Recv returns the next struct sent by the other end of the stream,
+// waiting for it to arrive.  io.EOF is returned once the other end has
+// called stream.CloseSend and every struct it sent has been read.
+// After a reset, structs that already arrived are returned before the
+// error.
+//
+func (stream *Stream) Recv() (interface{}, error) {
+	for {
+		select {
+		case item := <-stream.items:
+			stream.consume()
+			if item != nil {
+				return item, nil
+			}
+			continue
+		case <-stream.received:
+		}
+		select {
+		case item := <-stream.items:
+			if item != nil {
+				return item, nil
+			}
+		default:
+			stream.manipulation.Lock()
+			err := stream.err
+			stream.manipulation.Unlock()
+			if err == nil {
+				err = io.EOF
+			}
+			return nil, err
+		}
+	}
+}
+
+//
+// Count a struct taken from the stream, granting the other end more
+// credit once half the window has been read.
+//
+func (stream *Stream) consume() {
+	stream.manipulation.Lock()
+	stream.consumed += 1
+	credit := 0
+	if stream.consumed >= StreamWindow/2 && !stream.receiveClosed {
+		credit = stream.consumed
+		stream.consumed = 0
+	}
+	stream.manipulation.Unlock()
+	if credit > 0 {
+		stream.write(StreamFrame{
+			Kind:   StreamCredit,
+			Credit: credit,
+		})
+	}
+}
+
+//
+// CloseSend tells the other end no more structs will be sent, after
+// which its stream.Recv returns io.EOF.  Structs can still be received
+// until the other end closes its side as well.
+//
+func (stream *Stream) CloseSend() error {
+	stream.manipulation.Lock()
+	if stream.err != nil {
+		err := stream.err
+		stream.manipulation.Unlock()
+		return err
+	}
+	if stream.sendClosed {
+		stream.manipulation.Unlock()
+		return ErrStreamClosed
+	}
+	stream.sendClosed = true
+	done := stream.receiveClosed
+	stream.credited.Broadcast()
+	stream.manipulation.Unlock()
+	err := stream.write(StreamFrame{
+		Kind: StreamHalfClose,
+	})
+	if done {
+		stream.finish()
+	}
+	return err
+}
+
+//
+// Reset aborts the stream in both directions, telling the other end
+// why.  Afterwards stream.Send returns err, as does stream.Recv once
+// any structs that already arrived have been read.
+//
+func (stream *Stream) Reset(err error) error {
+	stream.manipulation.Lock()
+	done := stream.err != nil || (stream.sendClosed && stream.receiveClosed)
+	stream.manipulation.Unlock()
+	if done {
+		return ErrStreamClosed
+	}
+	write_err := stream.write(StreamFrame{
+		Kind:    StreamReset,
+		Message: err.Error(),
+	})
+	stream.fail(err)
+	return write_err
+}
+
+//
+// Done returns a channel that is closed once both ends have closed
+// their side of the stream or it has been reset.
+//
+func (stream *Stream) Done() <-chan struct{} {
+	return stream.finished
+}
+
+//
+// Handle a frame the other end sent on the stream, building any struct
+// it carries with the context it was read in.  An error is only
+// returned if the struct's Builder panicked.
+//
+func (stream *Stream) receive(frame *StreamFrame, context TLBContext) error {
+	switch frame.Kind {
+	case StreamCredit:
+		stream.manipulation.Lock()
+		stream.credit += frame.Credit
+		stream.credited.Broadcast()
+		stream.manipulation.Unlock()
+	case StreamReset:
+		stream.fail(fmt.Errorf("%w: %s", ErrStreamReset, frame.Message))
+	case StreamHalfClose:
+		stream.manipulation.Lock()
+		if stream.receiveClosed {
+			stream.manipulation.Unlock()
+			return nil
+		}
+		stream.receiveClosed = true
+		close(stream.received)
+		done := stream.sendClosed
+		stream.manipulation.Unlock()
+		if done {
+			stream.finish()
+		}
+	case StreamData:
+		stream.manipulation.Lock()
+		discarding := stream.discarding
+		stream.manipulation.Unlock()
+		if discarding {
+			stream.consume()
+			return nil
+		}
+		var item interface{}
+		struct_type, present := context.Handshake.LocalCode(frame.Type)
+		if present {
+			var err error
+			item, err = stream.TypeStore.buildType(struct_type, []byte(frame.Data), context)
+			if err != nil {
+				stream.consume()
+				return err
+			}
+		}
+		select {
+		case stream.items <- item:
+		default:
+			stream.Reset(ErrStreamOverflow)
+		}
+	}
+	return nil
+}
+
+//
+// Stop the stream because of err, waking anything waiting to send or
+// receive on it.
+//
+func (stream *Stream) fail(err error) {
+	stream.manipulation.Lock()
+	if stream.err != nil || (stream.sendClosed && stream.receiveClosed) {
+		stream.manipulation.Unlock()
+		return
+	}
+	stream.err = err
+	if !stream.receiveClosed {
+		stream.receiveClosed = true
+		close(stream.received)
+	}
+	stream.credited.Broadcast()
+	stream.manipulation.Unlock()
+	stream.finish()
+}
+
+//
+// Remove the finished stream from its Client or Connection.
+//
+func (stream *Stream) finish() {
+	stream.finishing.Do(func() {
+		close(stream.finished)
+		stream.unregister()
+	})
+}
+
+//
+// Close the sending side of a stream whose callback has returned if
+// the callback did not, and discard anything else the other end sends
+// so it is never left waiting for credit.
+//
+func (stream *Stream) abandon() {
+	stream.manipulation.Lock()
+	send_open := stream.err == nil && !stream.sendClosed
+	stream.discarding = true
+	stream.manipulation.Unlock()
+	for len(stream.items) > 0 {
+		<-stream.items
+		stream.consume()
+	}
+	if send_open {
+		stream.CloseSend()
+	}
+}
+
+//
+// OpenStream opens a Stream to the server with a struct that selects
+// the server.AcceptStream callback that will serve it.  stream.Send
+// waits until the server has accepted the stream, and the stream is
+// reset with ctx's error if ctx is done before the stream finishes.
+//
+func (client *Client) OpenStream(ctx context.Context, instance interface{}) (*Stream, error) {
+	struct_type, present := client.TypeStore.LookupCode(reflect.TypeOf(instance))
+	if !present {
+		return nil, errors.New("cannot open stream with type not in type store")
+	}
+	data, err := client.TypeStore.Codec.Marshal(instance)
+	if err != nil {
+		return nil, err
+	}
+	client.RequestsManipulation.Lock()
+	if client.Err() != nil {
+		client.RequestsManipulation.Unlock()
+		return nil, ErrConnectionClosed
+	}
+	request_id, err := client.getRequestID()
+	if err != nil {
+		client.RequestsManipulation.Unlock()
+		return nil, err
+	}
+	stream := newStream(request_id, true, client.TypeStore, 0, client.message, func() {
+		client.RequestsManipulation.Lock()
+		delete(client.Requests, request_id)
+		delete(client.Streams, request_id)
+		client.RequestsManipulation.Unlock()
+	})
+	client.Requests[request_id] = &RequestState{
+		Callbacks: make(map[uint16][]func(interface{})),
+		Failures:  []func(error){stream.fail},
+	}
+	client.Streams[request_id] = stream
+	client.RequestsManipulation.Unlock()
+	err = stream.write(StreamFrame{
+		Kind: StreamOpen,
+		Type: struct_type,
+		Data: string(data),
+	})
+	if err != nil {
+		stream.fail(err)
+		return nil, err
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			stream.Reset(ctx.Err())
+		case <-stream.finished:
+		}
+	}()
+	return stream, nil
+}
+
+//
+// Pass a frame for a stream this Client opened to the stream.
+//
+func (client *Client) handleStreamFrame(frame *StreamFrame, context TLBContext) {
+	if !frame.Opener {
+		client.RequestsManipulation.Lock()
+		stream := client.Streams[frame.RequestID]
+		client.RequestsManipulation.Unlock()
+		if stream == nil {
+			return
+		}
+		if handler_panic, ok := stream.receive(frame, context).(*HandlerPanic); ok {
+			if client.panics.report(handler_panic) {
+				client.shutdown(handler_panic)
+			}
+		}
+	}
+}
+
+//
+// Create a new callback to be ran when a socket with a certain tag opens
+// a Stream with a specific type of struct.  The callback is given the
+// struct the stream was opened with and the Stream, whose sending side
+// is closed when the callback returns if the callback has not closed
+// it.  Only one callback is run for each stream, and a stream no
+// callback accepts is reset.  An error is returned if the type is not
+// in the server's TypeStore or the function is nil.
+//
+func (server *Server) AcceptStream(socket_tag string, struct_type reflect.Type, function func(interface{}, *Stream, TLBContext)) error {
+	if struct_type == nil {
+		return server.misuse(errors.New("struct type cannot be nil"))
+	}
+	if function == nil {
+		return server.misuse(errors.New("function cannot be nil"))
+	}
+	type_code, err := server.typeCode(struct_type)
+	if err != nil {
+		return server.misuse(err)
+	}
+	server.InsertStreams.Lock()
+	if server.Streams[socket_tag] == nil {
+		server.Streams[socket_tag] = make(map[uint16]func(interface{}, *Stream, TLBContext))
+	}
+	server.Streams[socket_tag][type_code] = function
+	server.InsertStreams.Unlock()
+	return nil
+}
+
+//
+// Handle a frame for a stream the other end of a socket opened, running
+// the AcceptStream callback for the socket's tags when it is opened.
+//
+func (server *Server) handleStreamFrame(frame *StreamFrame, tags []string, context TLBContext) {
+	if !frame.Opener {
+		return
+	}
+	connection := server.Connection(context.Socket)
+	if connection == nil {
+		return
+	}
+	connection.StreamsManipulation.Lock()
+	stream, present := connection.Streams[frame.RequestID]
+	connection.StreamsManipulation.Unlock()
+	if frame.Kind != StreamOpen {
+		if !present {
+			return
+		}
+		if handler_panic, ok := stream.receive(frame, context).(*HandlerPanic); ok {
+			if server.panics.report(handler_panic) {
+				context.Socket.Close()
+			}
+		}
+		return
+	}
+	if present {
+		return
+	}
+	request_id := frame.RequestID
+	stream = newStream(request_id, false, server.TypeStore, StreamWindow, func(instance interface{}) error {
+		frame_bytes, err := server.TypeStore.Format(instance)
+		if err != nil {
+			return err
+		}
+		return server.write(context.Socket, frame_bytes)
+	}, func() {
+		connection.StreamsManipulation.Lock()
+		delete(connection.Streams, request_id)
+		connection.StreamsManipulation.Unlock()
+	})
+	struct_type, present := context.Handshake.LocalCode(frame.Type)
+	var function func(interface{}, *Stream, TLBContext)
+	ordered := false
+	server.InsertStreams.Lock()
+	for _, tag := range tags {
+		if function = server.Streams[tag][struct_type]; function != nil {
+			ordered = server.inOrder(tag, struct_type)
+			break
+		}
+	}
+	server.InsertStreams.Unlock()
+	if !present || function == nil || server.closing() {
+		stream.Reset(errors.New("stream not accepted"))
+		return
+	}
+	recieved_struct, err := server.TypeStore.buildType(struct_type, []byte(frame.Data), context)
+	if handler_panic, ok := err.(*HandlerPanic); ok {
+		stream.Reset(errors.New("stream not accepted"))
+		if server.panics.report(handler_panic) {
+			context.Socket.Close()
+		}
+		return
+	}
+	if recieved_struct == nil {
+		stream.Reset(errors.New("stream not accepted"))
+		return
+	}
+	connection.StreamsManipulation.Lock()
+	connection.Streams[request_id] = stream
+	connection.StreamsManipulation.Unlock()
+	stream.write(StreamFrame{
+		Kind:   StreamCredit,
+		Credit: StreamWindow,
+	})
+	server.dispatch(func() {
+		server.run(func(iface interface{}, context TLBContext) {
+			defer stream.abandon()
+			function(iface, stream, context)
+		}, recieved_struct, context, ordered, nil)
+	})
+}
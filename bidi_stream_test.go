@@ -0,0 +1,203 @@
+package tlb_test
+
+import (
+	"context"
+	"errors"
+	. "github.com/hkparker/TLB"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io"
+	"net"
+	"reflect"
+	"time"
+)
+
+var _ = Describe("Bidirectional streams", func() {
+
+	fixture := useTestServer(func(type_store TypeStore) {
+		type_store.AddType(reflect.TypeOf(Gadget{}), reflect.TypeOf(&Gadget{}), BuildGadget)
+	})
+	dial := fixture.dial
+
+	importer := func(_ interface{}, stream *Stream, _ TLBContext) {
+		imported := 0
+		for {
+			iface, err := stream.Recv()
+			if err != nil {
+				break
+			}
+			if _, correct_type := iface.(*Gadget); correct_type {
+				imported += 1
+				if imported%50 == 0 {
+					stream.Send(Thingy{Name: "progress", ID: imported})
+				}
+			}
+		}
+		stream.Send(Thingy{Name: "done", ID: imported})
+	}
+
+	upload := func(stream *Stream, count int) chan error {
+		errs := make(chan error, 1)
+		go func() {
+			for i := 0; i < count; i++ {
+				if err := stream.Send(Gadget{Size: i}); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- stream.CloseSend()
+		}()
+		return errs
+	}
+
+	It("uploads structs while receiving progress until both sides close", func() {
+		fixture.server.AcceptStream("all", reflect.TypeOf(Thingy{}), importer)
+		client := dial()
+		defer client.Close()
+		stream, err := client.OpenStream(fixture.ctx, Thingy{Name: "import"})
+		Expect(err).To(BeNil())
+		uploaded := upload(stream, 200)
+		var received []Thingy
+		for {
+			iface, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			Expect(err).To(BeNil())
+			received = append(received, *iface.(*Thingy))
+		}
+		Expect(received).To(Equal([]Thingy{
+			{Name: "progress", ID: 50},
+			{Name: "progress", ID: 100},
+			{Name: "progress", ID: 150},
+			{Name: "progress", ID: 200},
+			{Name: "done", ID: 200},
+		}))
+		Eventually(uploaded).Should(Receive(BeNil()))
+		Eventually(stream.Done()).Should(BeClosed())
+		client.RequestsManipulation.Lock()
+		Expect(client.Requests).To(BeEmpty())
+		Expect(client.Streams).To(BeEmpty())
+		client.RequestsManipulation.Unlock()
+	})
+
+	It("stops sending when the other end stops reading", func() {
+		release := make(chan bool)
+		fixture.server.AcceptStream("all", reflect.TypeOf(Thingy{}), func(_ interface{}, stream *Stream, _ TLBContext) {
+			<-release
+			for {
+				if _, err := stream.Recv(); err != nil {
+					return
+				}
+			}
+		})
+		client := dial()
+		defer client.Close()
+		stream, err := client.OpenStream(fixture.ctx, Thingy{})
+		Expect(err).To(BeNil())
+		sent := make(chan int, StreamWindow+1)
+		go func() {
+			for i := 0; i <= StreamWindow; i++ {
+				if stream.Send(Gadget{Size: i}) != nil {
+					return
+				}
+				sent <- i
+			}
+		}()
+		for i := 0; i < StreamWindow; i++ {
+			Eventually(sent).Should(Receive(Equal(i)))
+		}
+		Consistently(sent, 100*time.Millisecond).ShouldNot(Receive())
+		close(release)
+		Eventually(sent).Should(Receive(Equal(StreamWindow)))
+	})
+
+	It("resets streams no callback accepts", func() {
+		client := dial()
+		defer client.Close()
+		stream, err := client.OpenStream(fixture.ctx, Thingy{})
+		Expect(err).To(BeNil())
+		Expect(errors.Is(stream.Send(Gadget{}), ErrStreamReset)).To(BeTrue())
+		_, err = stream.Recv()
+		Expect(errors.Is(err, ErrStreamReset)).To(BeTrue())
+	})
+
+	It("passes resets from the server to the client with the reason", func() {
+		fixture.server.AcceptStream("all", reflect.TypeOf(Thingy{}), func(_ interface{}, stream *Stream, _ TLBContext) {
+			stream.Send(Thingy{ID: 1})
+			stream.Reset(errors.New("import failed"))
+		})
+		client := dial()
+		defer client.Close()
+		stream, err := client.OpenStream(fixture.ctx, Thingy{})
+		Expect(err).To(BeNil())
+		iface, err := stream.Recv()
+		Expect(err).To(BeNil())
+		Expect(iface).To(Equal(&Thingy{ID: 1}))
+		_, err = stream.Recv()
+		Expect(errors.Is(err, ErrStreamReset)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("import failed"))
+		Expect(errors.Is(stream.Send(Gadget{}), ErrStreamReset)).To(BeTrue())
+	})
+
+	It("resets the stream when the client's context is done", func() {
+		errs := make(chan error, 1)
+		fixture.server.AcceptStream("all", reflect.TypeOf(Thingy{}), func(_ interface{}, stream *Stream, _ TLBContext) {
+			_, err := stream.Recv()
+			errs <- err
+		})
+		client := dial()
+		defer client.Close()
+		short, short_cancel := context.WithCancel(fixture.ctx)
+		stream, err := client.OpenStream(short, Thingy{})
+		Expect(err).To(BeNil())
+		short_cancel()
+		var server_err error
+		Eventually(errs).Should(Receive(&server_err))
+		Expect(errors.Is(server_err, ErrStreamReset)).To(BeTrue())
+		_, err = stream.Recv()
+		Expect(err).To(Equal(context.Canceled))
+	})
+
+	It("fails streams on the server when the client disconnects", func() {
+		errs := make(chan error, 1)
+		fixture.server.AcceptStream("all", reflect.TypeOf(Thingy{}), func(_ interface{}, stream *Stream, _ TLBContext) {
+			_, err := stream.Recv()
+			errs <- err
+		})
+		client := dial()
+		_, err := client.OpenStream(fixture.ctx, Thingy{})
+		Expect(err).To(BeNil())
+		client.RequestsManipulation.Lock()
+		Expect(client.Streams).To(HaveLen(1))
+		client.RequestsManipulation.Unlock()
+		client.Close()
+		Eventually(errs).Should(Receive(Equal(ErrConnectionClosed)))
+	})
+
+	It("streams in both directions between peers", func() {
+		left_socket, right_socket := net.Pipe()
+		left := NewPeer(left_socket, fixture.typeStore)
+		right := NewPeer(right_socket, fixture.typeStore)
+		defer left.Close()
+		defer right.Close()
+		Expect(left.AcceptStream(reflect.TypeOf(Thingy{}), importer)).To(BeNil())
+		Expect(right.AcceptStream(reflect.TypeOf(Thingy{}), importer)).To(BeNil())
+		for _, peer := range []Peer{left, right} {
+			stream, err := peer.OpenStream(fixture.ctx, Thingy{})
+			Expect(err).To(BeNil())
+			uploaded := upload(stream, 100)
+			var last interface{}
+			for {
+				iface, err := stream.Recv()
+				if err == io.EOF {
+					break
+				}
+				Expect(err).To(BeNil())
+				last = iface
+			}
+			Expect(last).To(Equal(&Thingy{Name: "done", ID: 100}))
+			Eventually(uploaded).Should(Receive(BeNil()))
+		}
+	})
+})
@@ -0,0 +1,179 @@
+package tlb
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+//
+// A BroadcastError is returned by server.Broadcast when some of the
+// sockets could not be sent the struct, with the reason for each one.
+//
+type BroadcastError struct {
+	Failures []SocketError
+}
+
+//
+// Error allows a BroadcastError to be used as an error.
+//
+func (broadcast_error BroadcastError) Error() string {
+	return fmt.Sprintf("broadcast failed on %d sockets", len(broadcast_error.Failures))
+}
+
+//
+// How many broadcast structs each socket can have waiting to be
+// written before it is closed with ErrBroadcastQueueFull, unless
+// server.BroadcastQueue is set otherwise.
+//
+const DefaultBroadcastQueue = 256
+
+//
+// ErrBroadcastQueueFull is the reason a socket is closed when it falls
+// server.BroadcastQueue structs behind on broadcasts.
+//
+var ErrBroadcastQueueFull = errors.New("broadcast queue full")
+
+//
+// A broadcastQueue holds the broadcast structs a socket has not been
+// sent yet, so that Broadcast never waits on a slow socket.  While it
+// is not empty one goroutine writes it in order.  Once a write fails,
+// or the queue fills up, failure is set and nothing more is queued.
+//
+type broadcastQueue struct {
+	messages     [][]byte
+	writing      bool
+	failure      error
+	manipulation *sync.Mutex
+}
+
+//
+// Broadcast sends a struct to every socket with a tag.  The struct is
+// formatted once and queued for each socket, and Broadcast returns
+// without waiting for the writes.  Each socket has its own queue that
+// is written in order, so structs broadcast one after another arrive in
+// order, and a socket that stops reading only holds up its own queue.
+// A socket that falls server.BroadcastQueue structs behind is closed
+// with ErrBroadcastQueueFull and returned in a BroadcastError, as are
+// sockets whose earlier broadcasts failed.  Sockets that fail to be
+// written to are removed from the server and reported on FailedSockets.
+// An error is also returned if the struct cannot be formatted.
+//
+func (server *Server) Broadcast(socket_tag string, instance interface{}) error {
+	return server.BroadcastExcept(socket_tag, instance, nil)
+}
+
+//
+// BroadcastExcept is Broadcast to every socket with a tag other than
+// omit, usually the socket that sent the struct being passed on.
+//
+func (server *Server) BroadcastExcept(socket_tag string, instance interface{}, omit net.Conn) error {
+	return server.interceptors.wrapSender(func(instance interface{}) error {
+		message, err := server.TypeStore.Format(instance)
+		if err != nil {
+			return err
+		}
+		server.TagManipulation.Lock()
+		sockets := ExcludeConn(server.Sockets[socket_tag], omit)
+		server.TagManipulation.Unlock()
+		var failures []SocketError
+		for _, socket := range sockets {
+			connection := server.Connection(socket)
+			if connection == nil {
+				continue
+			}
+			if err := server.queueBroadcast(connection, message); err != nil {
+				failures = append(failures, SocketError{Socket: socket, Err: err})
+			}
+		}
+		if len(failures) > 0 {
+			return BroadcastError{
+				Failures: failures,
+			}
+		}
+		return nil
+	})(instance)
+}
+
+//
+// Queue a broadcast struct for a Connection, starting a goroutine to
+// write the queue if one is not already running.  If the queue is full
+// the Connection is closed and removed from the server.
+//
+func (server *Server) queueBroadcast(connection *Connection, message []byte) error {
+	queue := connection.broadcasts
+	queue.manipulation.Lock()
+	if queue.failure != nil {
+		queue.manipulation.Unlock()
+		return queue.failure
+	}
+	if server.BroadcastQueue > 0 && len(queue.messages) >= server.BroadcastQueue {
+		queue.failure = ErrBroadcastQueueFull
+		queue.messages = nil
+		queue.manipulation.Unlock()
+		server.Delete(connection.Socket)
+		connection.Fail(ErrBroadcastQueueFull)
+		return ErrBroadcastQueueFull
+	}
+	queue.messages = append(queue.messages, message)
+	start := !queue.writing
+	queue.writing = true
+	queue.manipulation.Unlock()
+	if start {
+		go server.writeBroadcasts(connection)
+	}
+	return nil
+}
+
+//
+// Write a Connection's queued broadcast structs until the queue is
+// empty or a write fails, in which case the socket is removed from the
+// server and reported on FailedSockets unless the queue had already
+// failed.
+//
+func (server Server) writeBroadcasts(connection *Connection) {
+	queue := connection.broadcasts
+	for {
+		queue.manipulation.Lock()
+		if len(queue.messages) == 0 || queue.failure != nil {
+			queue.writing = false
+			queue.manipulation.Unlock()
+			return
+		}
+		message := queue.messages[0]
+		queue.messages[0] = nil
+		queue.messages = queue.messages[1:]
+		queue.manipulation.Unlock()
+		err := connection.Write(message)
+		if err == nil {
+			continue
+		}
+		queue.manipulation.Lock()
+		failed := queue.failure != nil
+		if !failed {
+			queue.failure = err
+			queue.messages = nil
+		}
+		queue.manipulation.Unlock()
+		if !failed && err != ErrIdleTimeout {
+			server.dropSocket(connection.Socket, err)
+		}
+	}
+}
+
+//
+// Send a struct to one socket, such as a client that subscribed to
+// updates earlier.  Clients run the callbacks registered for the
+// struct's type with client.On.  The socket is removed from the server
+// and reported on FailedSockets if the write fails.
+//
+func (server *Server) Send(socket net.Conn, instance interface{}) error {
+	return server.interceptors.wrapSender(func(instance interface{}) error {
+		message, err := server.TypeStore.Format(instance)
+		if err != nil {
+			return err
+		}
+		return server.write(socket, message)
+	})(instance)
+}
@@ -0,0 +1,198 @@
+package tlb_test
+
+import (
+	"errors"
+	. "github.com/hkparker/TLB"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net"
+	"reflect"
+	"time"
+)
+
+var _ = Describe("Broadcast", func() {
+
+	var (
+		type_store TypeStore
+		listener   net.Listener
+		server     Server
+		tagged     chan net.Conn
+	)
+
+	BeforeEach(func() {
+		type_store = NewTypeStore()
+		type_store.AddType(reflect.TypeOf(Thingy{}), reflect.TypeOf(&Thingy{}), BuildThingy)
+		var err error
+		listener, err = net.Listen("tcp", "localhost:0")
+		Expect(err).To(BeNil())
+		tagged = make(chan net.Conn, 3)
+		server = NewServer(listener, func(socket net.Conn, server *Server) {
+			server.TagSocket(socket, "all")
+			tagged <- socket
+		}, type_store)
+	})
+
+	AfterEach(func() {
+		listener.Close()
+	})
+
+	connect := func() (net.Conn, net.Conn) {
+		client_socket, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).To(BeNil())
+		var server_socket net.Conn
+		Eventually(tagged).Should(Receive(&server_socket))
+		return client_socket, server_socket
+	}
+
+	receive := func(socket net.Conn) interface{} {
+		socket.SetReadDeadline(time.Now().Add(time.Second))
+		iface, err := type_store.NextStruct(socket, TLBContext{})
+		if err != nil {
+			return err
+		}
+		return iface
+	}
+
+	It("sends a struct to every socket with a tag", func() {
+		first, _ := connect()
+		defer first.Close()
+		second, _ := connect()
+		defer second.Close()
+		Expect(server.Broadcast("all", Thingy{Name: "broadcast", ID: 1})).To(BeNil())
+		Expect(receive(first)).To(Equal(&Thingy{Name: "broadcast", ID: 1}))
+		Expect(receive(second)).To(Equal(&Thingy{Name: "broadcast", ID: 1}))
+	})
+
+	It("can leave out one socket", func() {
+		first, omitted := connect()
+		defer first.Close()
+		second, _ := connect()
+		defer second.Close()
+		Expect(server.BroadcastExcept("all", Thingy{Name: "broadcast", ID: 1}, omitted)).To(BeNil())
+		Expect(receive(second)).To(Equal(&Thingy{Name: "broadcast", ID: 1}))
+		first.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, err := type_store.NextStruct(first, TLBContext{})
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("sends nothing to sockets without the tag", func() {
+		first, _ := connect()
+		defer first.Close()
+		Expect(server.Broadcast("none", Thingy{Name: "broadcast", ID: 1})).To(BeNil())
+		first.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, err := type_store.NextStruct(first, TLBContext{})
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("returns an error when the struct cannot be formatted", func() {
+		Expect(server.Broadcast("all", Gadget{Size: 1})).ToNot(BeNil())
+	})
+
+	It("delivers structs broadcast one after another in order", func() {
+		first, _ := connect()
+		defer first.Close()
+		for i := 0; i < 50; i++ {
+			Expect(server.Broadcast("all", Thingy{Name: "broadcast", ID: i})).To(BeNil())
+		}
+		for i := 0; i < 50; i++ {
+			Expect(receive(first)).To(Equal(&Thingy{Name: "broadcast", ID: i}))
+		}
+	})
+
+	It("reports the sockets that could not be written to", func() {
+		first, _ := connect()
+		defer first.Close()
+		closed, other := net.Pipe()
+		other.Close()
+		closed.Close()
+		server.TagSocket(closed, "all")
+		Expect(server.Broadcast("all", Thingy{Name: "broadcast", ID: 1})).To(BeNil())
+		Expect(receive(first)).To(Equal(&Thingy{Name: "broadcast", ID: 1}))
+		Eventually(server.FailedSockets).Should(Receive(Equal(closed)))
+	})
+
+	It("does not wait for sockets that stop reading", func() {
+		first, _ := connect()
+		defer first.Close()
+		stalled, other := net.Pipe()
+		defer stalled.Close()
+		defer other.Close()
+		server.TagSocket(stalled, "all")
+		server.BroadcastQueue = 4
+		var failures []SocketError
+		broadcasts := make(chan bool)
+		go func() {
+			for i := 0; i < 10; i++ {
+				err := server.Broadcast("all", Thingy{Name: "broadcast", ID: i})
+				var broadcast_error BroadcastError
+				if errors.As(err, &broadcast_error) {
+					failures = append(failures, broadcast_error.Failures...)
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			broadcasts <- true
+		}()
+		Eventually(broadcasts, time.Second).Should(Receive())
+		Expect(failures).To(HaveLen(1))
+		Expect(failures[0].Socket).To(Equal(stalled))
+		Expect(failures[0].Err).To(Equal(ErrBroadcastQueueFull))
+		for i := 0; i < 10; i++ {
+			Expect(receive(first)).To(Equal(&Thingy{Name: "broadcast", ID: i}))
+		}
+	})
+})
+
+var _ = Describe("Send", func() {
+
+	var type_store TypeStore
+
+	BeforeEach(func() {
+		type_store = NewTypeStore()
+		type_store.AddType(reflect.TypeOf(Thingy{}), reflect.TypeOf(&Thingy{}), BuildThingy)
+		type_store.AddType(reflect.TypeOf(Gadget{}), reflect.TypeOf(&Gadget{}), BuildGadget)
+	})
+
+	It("pushes a struct to a client that runs its callbacks", func() {
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).To(BeNil())
+		defer listener.Close()
+		server := NewServer(listener, TagSocketAll, type_store)
+		server.Accept("all", reflect.TypeOf(Thingy{}), func(_ interface{}, context TLBContext) {
+			context.Server.Send(context.Socket, Gadget{Size: 7})
+		})
+		client_socket, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).To(BeNil())
+		client := NewClient(client_socket, type_store, false)
+		defer client.Close()
+		sizes := make(chan int, 1)
+		err = client.On(reflect.TypeOf(Gadget{}), func(iface interface{}) {
+			if gadget, correct_type := iface.(*Gadget); correct_type {
+				sizes <- gadget.Size
+			}
+		})
+		Expect(err).To(BeNil())
+		Expect(client.Message(Thingy{Name: "subscribe"})).To(BeNil())
+		Eventually(sizes).Should(Receive(Equal(7)))
+	})
+
+	It("returns an error when the struct cannot be formatted", func() {
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).To(BeNil())
+		defer listener.Close()
+		server := NewServer(listener, TagSocketAll, NewTypeStore())
+		socket, other := net.Pipe()
+		defer socket.Close()
+		defer other.Close()
+		Expect(server.Send(socket, Gadget{Size: 1})).ToNot(BeNil())
+	})
+
+	It("refuses client callbacks for unknown types", func() {
+		socket, other := net.Pipe()
+		defer socket.Close()
+		defer other.Close()
+		client := NewClient(socket, NewTypeStore(), true)
+		Expect(client.On(reflect.TypeOf(Gadget{}), func(_ interface{}) {})).ToNot(BeNil())
+		Expect(client.On(reflect.TypeOf(ErrorResponse{}), nil)).ToNot(BeNil())
+		Expect(client.Events).To(BeEmpty())
+	})
+})
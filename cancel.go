@@ -0,0 +1,97 @@
+package tlb
+
+import (
+	"context"
+)
+
+//
+// A Cancel is sent by a client that has given up on a request, so the
+// server can cancel the Context of the callbacks handling it.
+//
+type Cancel struct {
+	RequestID uint32
+}
+
+//
+// A RunningRequest is stored in connection.Requests while the
+// AcceptRequest callbacks for a request are running.
+//
+type RunningRequest struct {
+	Cancel    context.CancelFunc
+	Callbacks int
+}
+
+//
+// Record a request that is about to be handled by a number of
+// callbacks, returning the Context they are given.
+//
+func (connection *Connection) startRequest(request_id uint32, parent context.Context, callbacks int) (context.Context, *RunningRequest) {
+	request_context, cancel := context.WithCancel(parent)
+	running := &RunningRequest{
+		Cancel:    cancel,
+		Callbacks: callbacks,
+	}
+	connection.RequestsManipulation.Lock()
+	connection.Requests[request_id] = running
+	connection.RequestsManipulation.Unlock()
+	return request_context, running
+}
+
+//
+// Count one of a request's callbacks as returned, cancelling its
+// Context and forgetting it once they all have.
+//
+func (connection *Connection) finishRequest(request_id uint32, running *RunningRequest) {
+	connection.RequestsManipulation.Lock()
+	running.Callbacks -= 1
+	done := running.Callbacks <= 0
+	if done && connection.Requests[request_id] == running {
+		delete(connection.Requests, request_id)
+	}
+	connection.RequestsManipulation.Unlock()
+	if done {
+		running.Cancel()
+	}
+}
+
+//
+// Cancel a request's Context and forget it without waiting for its
+// callbacks.
+//
+func (connection *Connection) stopRequest(request_id uint32, running *RunningRequest) {
+	connection.RequestsManipulation.Lock()
+	if connection.Requests[request_id] == running {
+		delete(connection.Requests, request_id)
+	}
+	connection.RequestsManipulation.Unlock()
+	running.Cancel()
+}
+
+//
+// Cancel the Context of a running request because the client sent a
+// Cancel for it.
+//
+func (connection *Connection) cancelRequest(request_id uint32) {
+	connection.RequestsManipulation.Lock()
+	running, present := connection.Requests[request_id]
+	delete(connection.Requests, request_id)
+	connection.RequestsManipulation.Unlock()
+	if present {
+		running.Cancel()
+	}
+}
+
+//
+// Tell the server to stop working on a request, if it is known to
+// understand Cancels.
+//
+func (client *Client) cancel(request_id uint32) {
+	client.RequestsManipulation.Lock()
+	cancel_requests := client.CancelRequests
+	client.RequestsManipulation.Unlock()
+	if cancel_requests {
+		client.message(Cancel{
+			RequestID: request_id,
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package tlb_test
+
+import (
+	"context"
+	. "github.com/hkparker/TLB"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net"
+	"reflect"
+	"time"
+)
+
+var _ = Describe("Cancellation", func() {
+
+	fixture := useTestServer()
+
+	dial := func(handshake bool) Client {
+		client := fixture.dial()
+		if handshake {
+			_, err := client.Handshake(fixture.ctx)
+			Expect(err).To(BeNil())
+			Expect(client.CancelRequests).To(BeTrue())
+		}
+		return client
+	}
+
+	waitFor := func(cancelled chan error) func(interface{}, TLBContext) {
+		return func(_ interface{}, context TLBContext) {
+			select {
+			case <-context.Context.Done():
+				cancelled <- context.Context.Err()
+			case <-time.After(time.Second):
+				context.Respond(Thingy{Name: "too late"})
+			}
+		}
+	}
+
+	It("cancels the handler's context when RequestContext gives up", func() {
+		cancelled := make(chan error, 1)
+		wait := waitFor(cancelled)
+		fixture.server.AcceptRequest("all", reflect.TypeOf(Thingy{}), wait)
+		client := dial(true)
+		defer client.Close()
+		short, short_cancel := context.WithTimeout(fixture.ctx, 50*time.Millisecond)
+		defer short_cancel()
+		_, err := client.RequestContext(short, Thingy{}, reflect.TypeOf(Thingy{}))
+		Expect(err).To(Equal(context.DeadlineExceeded))
+		Eventually(cancelled).Should(Receive(Equal(context.Canceled)))
+	})
+
+	It("cancels the handler's context when the request times out", func() {
+		cancelled := make(chan error, 1)
+		wait := waitFor(cancelled)
+		fixture.server.AcceptRequest("all", reflect.TypeOf(Thingy{}), wait)
+		client := dial(true)
+		defer client.Close()
+		client.RequestTimeout = 50 * time.Millisecond
+		_, err := client.RequestContext(fixture.ctx, Thingy{}, reflect.TypeOf(Thingy{}))
+		Expect(err).To(Equal(ErrRequestTimeout))
+		Eventually(cancelled).Should(Receive(Equal(context.Canceled)))
+	})
+
+	It("cancels the handler's context when the request is cancelled", func() {
+		cancelled := make(chan error, 1)
+		wait := waitFor(cancelled)
+		started := make(chan bool, 1)
+		fixture.server.AcceptRequest("all", reflect.TypeOf(Thingy{}), func(iface interface{}, context TLBContext) {
+			started <- true
+			wait(iface, context)
+		})
+		client := dial(true)
+		defer client.Close()
+		request, err := client.Request(Thingy{})
+		Expect(err).To(BeNil())
+		Eventually(started).Should(Receive())
+		request.Cancel()
+		Eventually(cancelled).Should(Receive(Equal(context.Canceled)))
+	})
+
+	It("cancels the handler's context when a response stream is closed early", func() {
+		cancelled := make(chan error, 1)
+		wait := waitFor(cancelled)
+		fixture.server.AcceptRequest("all", reflect.TypeOf(Thingy{}), func(iface interface{}, context TLBContext) {
+			context.Stream().Send(Thingy{ID: 1})
+			wait(iface, context)
+		})
+		client := dial(true)
+		defer client.Close()
+		stream, err := client.RequestStream(fixture.ctx, Thingy{}, reflect.TypeOf(Thingy{}))
+		Expect(err).To(BeNil())
+		_, err = stream.Next()
+		Expect(err).To(BeNil())
+		stream.Close()
+		Eventually(cancelled).Should(Receive(Equal(context.Canceled)))
+	})
+
+	It("does not cancel requests that were answered when they time out", func() {
+		cancelled := make(chan error, 1)
+		wait := waitFor(cancelled)
+		fixture.server.AcceptRequest("all", reflect.TypeOf(Thingy{}), func(iface interface{}, context TLBContext) {
+			time.Sleep(50 * time.Millisecond)
+			context.Respond(Thingy{Name: "answered"})
+			wait(iface, context)
+		})
+		client := dial(true)
+		defer client.Close()
+		client.RequestTimeout = 100 * time.Millisecond
+		request, err := client.Request(Thingy{})
+		Expect(err).To(BeNil())
+		responses := make(chan interface{}, 1)
+		request.OnResponse(reflect.TypeOf(Thingy{}), func(iface interface{}) {
+			responses <- iface
+		})
+		Eventually(responses).Should(Receive(Equal(&Thingy{Name: "answered"})))
+		Consistently(cancelled, 300*time.Millisecond).ShouldNot(Receive())
+	})
+
+	It("does not send Cancels to servers that have not shaken hands", func() {
+		cancelled := make(chan error, 1)
+		wait := waitFor(cancelled)
+		fixture.server.AcceptRequest("all", reflect.TypeOf(Thingy{}), wait)
+		client := dial(false)
+		defer client.Close()
+		Expect(client.CancelRequests).To(BeFalse())
+		request, err := client.Request(Thingy{})
+		Expect(err).To(BeNil())
+		request.Cancel()
+		Consistently(cancelled, 200*time.Millisecond).ShouldNot(Receive())
+		Expect(client.Err()).To(BeNil())
+	})
+
+	It("cancels the handler's context when the socket closes", func() {
+		cancelled := make(chan error, 1)
+		wait := waitFor(cancelled)
+		started := make(chan bool, 1)
+		fixture.server.AcceptRequest("all", reflect.TypeOf(Thingy{}), func(iface interface{}, context TLBContext) {
+			started <- true
+			wait(iface, context)
+		})
+		client := dial(false)
+		_, err := client.Request(Thingy{})
+		Expect(err).To(BeNil())
+		Eventually(started).Should(Receive())
+		client.Close()
+		Eventually(cancelled).Should(Receive(Equal(context.Canceled)))
+	})
+
+	It("cancels the handler's context once the handler returns", func() {
+		contexts := make(chan context.Context, 1)
+		fixture.server.AcceptRequest("all", reflect.TypeOf(Thingy{}), func(_ interface{}, context TLBContext) {
+			contexts <- context.Context
+			context.Respond(Thingy{})
+		})
+		client := dial(false)
+		defer client.Close()
+		_, err := client.RequestContext(fixture.ctx, Thingy{}, reflect.TypeOf(Thingy{}))
+		Expect(err).To(BeNil())
+		var handler_context context.Context
+		Eventually(contexts).Should(Receive(&handler_context))
+		Eventually(handler_context.Done()).Should(BeClosed())
+	})
+
+	It("cancels requests served by a Peer", func() {
+		cancelled := make(chan error, 1)
+		wait := waitFor(cancelled)
+		left_socket, right_socket := net.Pipe()
+		left := NewPeer(left_socket, fixture.typeStore)
+		right := NewPeer(right_socket, fixture.typeStore)
+		defer left.Close()
+		defer right.Close()
+		Expect(right.AcceptRequest(reflect.TypeOf(Thingy{}), wait)).To(BeNil())
+		_, err := left.Handshake(fixture.ctx)
+		Expect(err).To(BeNil())
+		short, short_cancel := context.WithTimeout(fixture.ctx, 50*time.Millisecond)
+		defer short_cancel()
+		_, err = left.RequestContext(short, Thingy{}, reflect.TypeOf(Thingy{}))
+		Expect(err).To(Equal(context.DeadlineExceeded))
+		Eventually(cancelled).Should(Receive(Equal(context.Canceled)))
+	})
+})
@@ -1,12 +1,29 @@
 package tlb
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
-	"gopkg.in/mgo.v2/bson"
 	"net"
 	"reflect"
 	"sync"
+	"time"
+)
+
+//
+// DefaultRequestTimeout is the RequestTimeout given to new Clients.
+//
+var DefaultRequestTimeout = 30 * time.Second
+
+//
+// Errors passed to request.OnError callbacks when a request is removed
+// from client.Requests before any response arrives.  ErrConnectionClosed
+// is also returned by requests made after the Client is done.
+//
+var (
+	ErrRequestTimeout   = errors.New("request timed out")
+	ErrRequestCancelled = errors.New("request cancelled")
+	ErrConnectionClosed = errors.New("connection closed")
 )
 
 //
@@ -16,27 +33,78 @@ import (
 type Client struct {
 	Socket               net.Conn
 	TypeStore            TypeStore
-	Requests             map[uint16]map[uint16][]func(interface{})
-	NextID               uint16
+	Requests             map[uint32]*RequestState
+	Streams              map[uint32]*Stream
+	Events               map[uint16][]func(interface{})
+	RequestTimeout       time.Duration
+	WideRequestIDs       bool
+	CancelRequests       bool
+	NextID               uint32
 	Writing              *sync.Mutex
 	RequestsManipulation *sync.Mutex
+	InsertEvents         *sync.Mutex
+	Dispatcher           *Dispatcher
+	Ordered              *Ordering
+	Heartbeat            *Heartbeat
+	Hellos               chan *Hello
+	GoAways              chan *GoAway
 	Dead                 chan error
+	closed               *closeState
+	panics               *panicHandler
+	interceptors         *interceptors
+	writeDeadline        *bool
+}
+
+//
+// The state shared by every copy of a Client once it is closed.
+//
+type closeState struct {
+	once sync.Once
+	done chan struct{}
+	err  error
 }
 
 //
 // Create a new Client with a net.Conn interface and a
 // TypeStore containing all types that will be seen on
-// the network.
+// the network.  Requests made by the Client expire after
+// DefaultRequestTimeout unless client.RequestTimeout is
+// changed, with zero disabling the timeout.  Request IDs are
+// 16 bits wide unless client.WideRequestIDs is set, which
+// should only be done when the server is known to understand
+// WideCapsules.  Likewise client.CancelRequests makes requests
+// that time out or are cancelled send the server a Cancel, and is
+// set by a handshake with a server that understands them.
+// Response callbacks are run by client.Dispatcher, and a dead
+// server is only detected once client.Heartbeat is configured.
+// The Dead channel receives the error that stopped the Client,
+// but only one reader can see it, so client.Done and client.Err
+// should be used instead.
 //
 func NewClient(socket net.Conn, type_store TypeStore, p2p bool) Client {
 	client := Client{
 		Socket:               socket,
 		TypeStore:            type_store,
-		Requests:             make(map[uint16]map[uint16][]func(interface{})),
+		Requests:             make(map[uint32]*RequestState),
+		Streams:              make(map[uint32]*Stream),
+		Events:               make(map[uint16][]func(interface{})),
+		RequestTimeout:       DefaultRequestTimeout,
 		NextID:               1,
 		Writing:              &sync.Mutex{},
 		RequestsManipulation: &sync.Mutex{},
+		InsertEvents:         &sync.Mutex{},
+		Dispatcher:           NewDispatcher(),
+		Ordered:              NewOrdering(),
+		Heartbeat:            NewHeartbeat(),
+		Hellos:               make(chan *Hello, 1),
+		GoAways:              make(chan *GoAway, 1),
 		Dead:                 make(chan error, 1),
+		closed: &closeState{
+			done: make(chan struct{}),
+		},
+		panics:        newPanicHandler(),
+		interceptors:  newInterceptors(),
+		writeDeadline: new(bool),
 	}
 	if !p2p {
 		go client.process()
@@ -51,39 +119,376 @@ func NewClient(socket net.Conn, type_store TypeStore, p2p bool) Client {
 //
 func (client *Client) process() {
 	context := TLBContext{
-		Socket: client.Socket,
+		Socket:  client.Socket,
+		Context: context.Background(),
 	}
+	beats := client.monitor()
+	read_deadline := false
 	for {
+		client.Heartbeat.setReadDeadline(client.Socket, &read_deadline)
 		iface, err := client.TypeStore.NextStruct(client.Socket, context)
+		if handler_panic, ok := err.(*HandlerPanic); ok {
+			if client.panics.report(handler_panic) {
+				client.shutdown(handler_panic)
+				break
+			}
+			continue
+		}
+		if _, ok := err.(*UnknownType); ok {
+			beat(beats)
+			continue
+		}
 		if err != nil {
-			client.Dead <- err
+			client.shutdown(idleError(err))
 			break
 		}
-		if capsule, ok := iface.(*Capsule); ok {
-			recieved_struct := client.TypeStore.BuildType(capsule.Type, []byte(capsule.Data), context)
-			if recieved_struct == nil {
+		beat(beats)
+		var capsule *WideCapsule
+		switch received := iface.(type) {
+		case *Hello:
+			if !received.Reply {
 				continue
 			}
-			client.RequestsManipulation.Lock()
-			if client.Requests[capsule.RequestID][capsule.Type] == nil {
-				continue
+			if handshake, err := client.TypeStore.negotiate(received); err == nil {
+				context.Handshake = handshake
+			}
+			select {
+			case client.Hellos <- received:
+			default:
 			}
-			for _, function := range client.Requests[capsule.RequestID][capsule.Type] {
-				go function(recieved_struct)
+			continue
+		case *GoAway:
+			select {
+			case client.GoAways <- received:
+			default:
 			}
-			client.RequestsManipulation.Unlock()
+			continue
+		case *HeartbeatPing:
+			client.message(HeartbeatPong{ID: received.ID})
+			continue
+		case *HeartbeatPong:
+			continue
+		case *Capsule:
+			capsule = received.Widen()
+		case *WideCapsule:
+			capsule = received
+		case *Reply:
+			capsule = received.Widen()
+		case *StreamFrame:
+			client.handleStreamFrame(received, context)
+			continue
+		case nil:
+			continue
+		default:
+			client.handleEvent(iface, context)
+			continue
+		}
+		client.handleResponse(capsule, context)
+	}
+}
+
+//
+// Run the callbacks registered with client.On for a struct the server
+// sent outside of a capsule.
+//
+func (client *Client) handleEvent(iface interface{}, context TLBContext) {
+	struct_type, present := client.TypeStore.LookupCode(reflect.TypeOf(iface))
+	if !present {
+		return
+	}
+	client.InsertEvents.Lock()
+	functions := client.Events[struct_type]
+	client.InsertEvents.Unlock()
+	ordered := client.Ordered.Covers(struct_type)
+	for _, function := range functions {
+		callback := function
+		client.run(func(iface interface{}, _ TLBContext) {
+			callback(iface)
+		}, iface, context, ordered)
+	}
+}
+
+//
+// Create a new callback to be ran when the server sends a specific type
+// of struct outside of a response, such as with server.Send or
+// server.Broadcast.  An error is returned if the type is not in the
+// client's TypeStore or the function is nil.
+//
+func (client *Client) On(struct_type reflect.Type, function func(interface{})) error {
+	if function == nil {
+		return errors.New("function cannot be nil")
+	}
+	codes, err := client.TypeStore.lookupCodes([]reflect.Type{struct_type})
+	if err != nil {
+		return err
+	}
+	client.InsertEvents.Lock()
+	client.Events[codes[0]] = append(client.Events[codes[0]], function)
+	client.InsertEvents.Unlock()
+	return nil
+}
+
+//
+// Build the struct inside a response capsule and run the callbacks
+// registered for it with request.OnResponse, or the request's error
+// callbacks if the server sent an ErrorResponse.
+//
+func (client *Client) handleResponse(capsule *WideCapsule, context TLBContext) {
+	struct_type, present := context.Handshake.LocalCode(capsule.Type)
+	if !present {
+		return
+	}
+	recieved_struct, err := client.TypeStore.buildType(struct_type, []byte(capsule.Data), context)
+	if handler_panic, ok := err.(*HandlerPanic); ok {
+		if client.panics.report(handler_panic) {
+			client.shutdown(handler_panic)
+		}
+		return
+	}
+	if recieved_struct == nil {
+		return
+	}
+	ordered := client.Ordered.Covers(struct_type)
+	if error_response, ok := recieved_struct.(*ErrorResponse); ok {
+		if len(error_response.Details) == 0 {
+			error_response.Details = nil
+		}
+		if state := client.removeRequest(capsule.RequestID); state != nil {
+			for _, function := range state.Failures {
+				failure := function
+				client.run(func(iface interface{}, _ TLBContext) {
+					if error_response, ok := iface.(*ErrorResponse); ok {
+						failure(*error_response)
+					}
+				}, error_response, context, ordered || state.Stream)
+			}
+		}
+		return
+	}
+	var functions []func(interface{})
+	if _, ok := recieved_struct.(*EndOfStream); ok {
+		if state := client.removeRequest(capsule.RequestID); state != nil {
+			functions = state.Callbacks[struct_type]
+			ordered = ordered || state.Stream
+		}
+	} else {
+		client.RequestsManipulation.Lock()
+		if state, present := client.Requests[capsule.RequestID]; present {
+			if state.Stream && !state.Responded && state.Timer != nil {
+				state.Timer.Stop()
+			}
+			state.Responded = true
+			functions = state.Callbacks[struct_type]
+			ordered = ordered || state.Stream
+		}
+		client.RequestsManipulation.Unlock()
+	}
+	for _, function := range functions {
+		callback := function
+		client.run(func(iface interface{}, _ TLBContext) {
+			callback(iface)
+		}, recieved_struct, context, ordered)
+	}
+}
+
+//
+// Run a response callback with the client's Dispatcher after wrapping
+// it in the client's interceptors, closing the Client if the socket's
+// queue overflowed and it is not already closing.
+//
+func (client *Client) run(callback Handler, obj interface{}, context TLBContext, ordered bool) {
+	handler := client.interceptors.wrap(callback)
+	job := func() {
+		defer client.recoverPanic()
+		handler(obj, context)
+	}
+	var err error
+	if ordered {
+		err = client.Dispatcher.SubmitOrdered(client.Socket, job)
+	} else {
+		err = client.Dispatcher.Submit(client.Socket, job)
+	}
+	if err == ErrQueueOverflow && client.Err() == nil {
+		client.shutdown(err)
+	}
+}
+
+//
+// Use adds interceptors that wrap every callback run for a response or
+// for a struct registered with client.On, including the error callbacks
+// of a request, which are passed the ErrorResponse or the error the
+// request failed with.  The first interceptor added runs first.
+//
+func (client *Client) Use(interceptors ...Interceptor) {
+	client.interceptors.use(interceptors)
+}
+
+//
+// UseOutbound adds interceptors that wrap every client.Message and
+// the struct sent with every request.  Pings, Cancels and the frames
+// of a Stream are not intercepted.  The first interceptor added runs
+// first.
+//
+func (client *Client) UseOutbound(interceptors ...OutboundInterceptor) {
+	client.interceptors.useOutbound(interceptors)
+}
+
+//
+// Recover from a panic in a callback, passing it to the hook set with
+// client.OnHandlerPanic and closing the Client if asked to.  Must be
+// deferred.
+//
+func (client *Client) recoverPanic() {
+	if value := recover(); value != nil {
+		handler_panic := newHandlerPanic(value, client.Socket)
+		if client.panics.report(handler_panic) {
+			client.shutdown(handler_panic)
+		}
+	}
+}
+
+//
+// OnHandlerPanic sets a hook that is run when a response or error
+// callback or a Builder panics.  The panic is recovered either way, and
+// if drop is set the Client is closed with the *HandlerPanic as its
+// error.
+//
+func (client *Client) OnHandlerPanic(hook func(HandlerPanic), drop bool) {
+	client.panics.set(hook, drop)
+}
+
+//
+// Run the response callbacks for some types one at a time, in the
+// order the responses arrived, instead of in parallel.  If no types
+// are given every response is delivered in order.  An error is
+// returned if a type is not in the client's TypeStore.
+//
+func (client *Client) InOrder(struct_types ...reflect.Type) error {
+	codes, err := client.TypeStore.lookupCodes(struct_types)
+	if err != nil {
+		return err
+	}
+	client.Ordered.add(codes)
+	return nil
+}
+
+//
+// Close closes the Client's socket, stopping the goroutine reading
+// from it, and fails every outstanding request with
+// ErrConnectionClosed.
+//
+func (client *Client) Close() error {
+	return client.shutdown(ErrConnectionClosed)
+}
+
+//
+// Done returns a channel that is closed once the Client has been
+// closed or its socket has failed.
+//
+func (client *Client) Done() <-chan struct{} {
+	return client.closed.done
+}
+
+//
+// Err returns nil until the Client is done, then ErrConnectionClosed
+// if it was closed with client.Close, or the error that stopped it
+// reading from its socket.
+//
+func (client *Client) Err() error {
+	select {
+	case <-client.closed.done:
+		return client.closed.err
+	default:
+		return nil
+	}
+}
+
+//
+// Mark the Client as done because of err, close its socket, and fail
+// every request in client.Requests.  Only the first call has any effect,
+// and returns any error from closing the socket.
+//
+func (client *Client) shutdown(err error) error {
+	var close_err error
+	client.closed.once.Do(func() {
+		client.closed.err = err
+		client.RequestsManipulation.Lock()
+		close(client.closed.done)
+		request_ids := make([]uint32, 0, len(client.Requests))
+		for request_id := range client.Requests {
+			request_ids = append(request_ids, request_id)
+		}
+		client.RequestsManipulation.Unlock()
+		close_err = client.Socket.Close()
+		for _, request_id := range request_ids {
+			client.failRequest(request_id, ErrConnectionClosed)
+		}
+		client.Dispatcher.Stop()
+		select {
+		case client.Dead <- err:
+		default:
+		}
+	})
+	return close_err
+}
+
+//
+// Handshake sends a Hello to the server and waits for its reply,
+// returning a description of the server or an error if the two
+// sides cannot talk to each other.  If the server supports wide
+// request IDs or Cancels they are enabled on this Client.  Handshakes require
+// the Client to be in Client-Server mode.
+//
+func (client *Client) Handshake(ctx context.Context) (*Handshake, error) {
+	err := client.message(client.TypeStore.hello(false))
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case hello := <-client.Hellos:
+		handshake, err := client.TypeStore.negotiate(hello)
+		if err != nil {
+			return nil, err
 		}
+		client.RequestsManipulation.Lock()
+		if handshake.Supports(CapabilityWideRequestIDs) {
+			client.WideRequestIDs = true
+		}
+		if handshake.Supports(CapabilityCancel) {
+			client.CancelRequests = true
+		}
+		client.RequestsManipulation.Unlock()
+		return handshake, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 }
 
 //
-// Return the next request ID to use for a capsule and increment
-// the counter.
+// Return the next request ID to use for a capsule and advance the
+// counter, wrapping around at the largest ID the capsule format can
+// carry.  IDs of requests still in client.Requests are skipped so
+// responses are never routed to the wrong callbacks.  Callers must
+// hold RequestsManipulation.
 //
-func (client *Client) getRequestID() uint16 {
-	id := client.NextID
-	client.NextID = id + 1
-	return id
+func (client *Client) getRequestID() (uint32, error) {
+	max_id := uint32(65535)
+	if client.WideRequestIDs {
+		max_id = 4294967295
+	}
+	if uint64(len(client.Requests)) >= uint64(max_id) {
+		return 0, errors.New("no request IDs available")
+	}
+	for {
+		id := client.NextID
+		if id == 0 || id > max_id {
+			id = 1
+		}
+		client.NextID = id + 1
+		if _, outstanding := client.Requests[id]; !outstanding {
+			return id, nil
+		}
+	}
 }
 
 //
@@ -91,45 +496,221 @@ func (client *Client) getRequestID() uint16 {
 // and write it down the client's net.Conn.
 //
 func (client *Client) Message(instance interface{}) error {
+	return client.interceptors.wrapSender(client.message)(instance)
+}
+
+//
+// Write a struct without running any outbound interceptors.  If the
+// write timeout passes the Client is closed with ErrIdleTimeout, since
+// part of the struct may have been written.
+//
+func (client *Client) message(instance interface{}) error {
 	message, err := client.TypeStore.Format(instance)
 	if err != nil {
 		return err
 	}
 	client.Writing.Lock()
+	client.Heartbeat.setWriteDeadline(client.Socket, client.writeDeadline)
 	_, err = client.Socket.Write(message)
 	client.Writing.Unlock()
+	if idleError(err) == ErrIdleTimeout {
+		client.shutdown(ErrIdleTimeout)
+		return ErrIdleTimeout
+	}
 	return err
 }
 
+//
+// Start sending Pings to the server as client.Heartbeat is configured,
+// until the Client is done, returning the channel beats should be sent
+// on whenever a struct is received.
+//
+func (client *Client) monitor() chan struct{} {
+	beats := make(chan struct{}, 1)
+	go client.Heartbeat.monitor(client.Socket, beats, client.closed.done, func(ping HeartbeatPing) error {
+		return client.message(ping)
+	}, func(err error) {
+		client.shutdown(err)
+	})
+	return beats
+}
+
 //
 // Given any struct in the Client's TypeStore, format the struct
 // inside a capsule and write it down the client's net.Conn.
 //
 func (client *Client) Request(instance interface{}) (Request, error) {
-	instance_data, err := bson.Marshal(instance)
+	request, err := client.newRequest(instance)
 	if err != nil {
-		return Request{}, err
+		return request, err
+	}
+	err = client.sendRequest(&request, instance)
+	if err != nil {
+		request.forget()
 	}
+	return request, err
+}
+
+//
+// RequestContext sends a struct inside a capsule and blocks until a
+// response of response_type arrives, the context is done, or the
+// request times out.  If the server responds with an ErrorResponse
+// it is returned as the error.  The response callback is registered before the
+// capsule is written, and the request is removed from client.Requests
+// when this returns.
+//
+func (client *Client) RequestContext(ctx context.Context, instance interface{}, response_type reflect.Type) (interface{}, error) {
+	if _, present := client.TypeStore.LookupCode(response_type); !present {
+		return nil, errors.New("cannot await response type not in type store")
+	}
+	request, err := client.newRequest(instance)
+	if err != nil {
+		return nil, err
+	}
+	defer request.forget()
+	responses := make(chan interface{}, 1)
+	failures := make(chan error, 1)
+	request.OnResponse(response_type, func(iface interface{}) {
+		select {
+		case responses <- iface:
+		default:
+		}
+	})
+	request.OnError(func(err error) {
+		failures <- err
+	})
+	err = client.sendRequest(&request, instance)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case response := <-responses:
+		return response, nil
+	case err := <-failures:
+		return nil, err
+	case <-ctx.Done():
+		request.abandon()
+		return nil, ctx.Err()
+	}
+}
+
+//
+// Reserve a request ID for a struct in client.Requests without
+// writing anything to the socket.  The request timeout starts here.
+//
+func (client *Client) newRequest(instance interface{}) (Request, error) {
 	instance_type, present := client.TypeStore.LookupCode(reflect.TypeOf(instance))
 	if !present {
 		return Request{}, errors.New("cannot request type not in type stores")
 	}
+	client.RequestsManipulation.Lock()
+	if client.Err() != nil {
+		client.RequestsManipulation.Unlock()
+		return Request{}, ErrConnectionClosed
+	}
+	request_id, err := client.getRequestID()
+	if err != nil {
+		client.RequestsManipulation.Unlock()
+		return Request{}, err
+	}
 	request := Request{
-		RequestID: client.getRequestID(),
+		RequestID: request_id,
 		Type:      instance_type,
-		Data:      string(instance_data),
+		Wide:      client.WideRequestIDs,
 		Client:    client,
 	}
-	capsule := Capsule{
-		RequestID: request.RequestID,
-		Type:      request.Type,
-		Data:      request.Data,
+	state := &RequestState{
+		Callbacks: make(map[uint16][]func(interface{})),
 	}
-	request.Client.RequestsManipulation.Lock()
-	client.Requests[request.RequestID] = make(map[uint16][]func(interface{}))
-	request.Client.RequestsManipulation.Unlock()
-	err = client.Message(capsule)
-	return request, err
+	if client.RequestTimeout > 0 {
+		state.Timer = time.AfterFunc(client.RequestTimeout, func() {
+			client.failRequest(request_id, ErrRequestTimeout)
+		})
+	}
+	client.Requests[request.RequestID] = state
+	client.RequestsManipulation.Unlock()
+	return request, nil
+}
+
+//
+// Remove a request from client.Requests and, if it never received a
+// response or is a stream that has not ended, run its error callbacks
+// with err on the client's Dispatcher and, unless the connection
+// closed, send the server a Cancel.  The error callbacks of a stream
+// run in order after the responses already received.
+//
+func (client *Client) failRequest(request_id uint32, err error) {
+	state := client.removeRequest(request_id)
+	if state == nil || !state.outstanding() {
+		return
+	}
+	if err != ErrConnectionClosed {
+		client.cancel(request_id)
+	}
+	context := TLBContext{
+		Socket:  client.Socket,
+		Context: context.Background(),
+	}
+	for _, function := range state.Failures {
+		failure := function
+		client.run(func(iface interface{}, _ TLBContext) {
+			if err, ok := iface.(error); ok {
+				failure(err)
+			}
+		}, err, context, state.Stream)
+	}
+}
+
+//
+// Remove a request from client.Requests and stop its timeout, returning
+// its RequestState or nil if the request was already removed.
+//
+func (client *Client) removeRequest(request_id uint32) *RequestState {
+	client.RequestsManipulation.Lock()
+	state, present := client.Requests[request_id]
+	delete(client.Requests, request_id)
+	client.RequestsManipulation.Unlock()
+	if !present {
+		return nil
+	}
+	if state.Timer != nil {
+		state.Timer.Stop()
+	}
+	return state
+}
+
+//
+// Write the struct for a request previously created with newRequest
+// to the socket inside of a capsule, or a WideCapsule if the request
+// ID is wide.  The struct is passed through the client's outbound
+// interceptors first, and the request is updated with the struct
+// that was sent.
+//
+func (client *Client) sendRequest(request *Request, instance interface{}) error {
+	return client.interceptors.wrapSender(func(instance interface{}) error {
+		instance_type, present := client.TypeStore.LookupCode(reflect.TypeOf(instance))
+		if !present {
+			return errors.New("cannot request type not in type stores")
+		}
+		instance_data, err := client.TypeStore.Codec.Marshal(instance)
+		if err != nil {
+			return err
+		}
+		request.Type = instance_type
+		request.Data = string(instance_data)
+		if request.Wide {
+			return client.message(WideCapsule{
+				RequestID: request.RequestID,
+				Type:      request.Type,
+				Data:      request.Data,
+			})
+		}
+		return client.message(Capsule{
+			RequestID: uint16(request.RequestID),
+			Type:      request.Type,
+			Data:      request.Data,
+		})
+	})(instance)
 }
 
 //
@@ -140,6 +721,7 @@ func (client *Client) Request(instance interface{}) (Request, error) {
 type StreamWriter struct {
 	Socket  net.Conn
 	TypeID  uint16
+	Codec   Codec
 	Writing *sync.Mutex
 }
 
@@ -151,6 +733,7 @@ type StreamWriter struct {
 func NewStreamWriter(conn net.Conn, type_store TypeStore, struct_type reflect.Type) (StreamWriter, error) {
 	writer := StreamWriter{
 		Socket:  conn,
+		Codec:   type_store.Codec,
 		Writing: &sync.Mutex{},
 	}
 	type_id, present := type_store.LookupCode(struct_type)
@@ -165,7 +748,7 @@ func NewStreamWriter(conn net.Conn, type_store TypeStore, struct_type reflect.Ty
 // Write a struct using the StreamWriter.
 //
 func (writer *StreamWriter) Write(obj interface{}) error {
-	bytes, err := bson.Marshal(obj)
+	bytes, err := writer.Codec.Marshal(obj)
 	if err != nil {
 		return err
 	}
@@ -189,12 +772,36 @@ func (writer *StreamWriter) Write(obj interface{}) error {
 // and can be used to handle server responses with request.OnResponse.
 //
 type Request struct {
-	RequestID uint16
+	RequestID uint32
 	Type      uint16
 	Data      string
+	Wide      bool
 	Client    *Client
 }
 
+//
+// RequestStates are stored in client.Requests for every outstanding
+// request and hold the callbacks that will handle its responses.
+// Responses to a Stream request are handled in the order they arrive,
+// and the request is failed if the connection closes before the
+// stream ends.
+//
+type RequestState struct {
+	Callbacks map[uint16][]func(interface{})
+	Failures  []func(error)
+	Timer     *time.Timer
+	Responded bool
+	Stream    bool
+}
+
+//
+// Report if the server may still be working on a request, because it
+// has not responded or is streaming responses that have not ended.
+//
+func (state *RequestState) outstanding() bool {
+	return !state.Responded || state.Stream
+}
+
 //
 // OnResponse is used to define the behaviors used to handle responses
 // to client.Request.
@@ -202,7 +809,51 @@ type Request struct {
 func (request *Request) OnResponse(struct_type reflect.Type, function func(interface{})) {
 	if type_id, present := request.Client.TypeStore.LookupCode(struct_type); present {
 		request.Client.RequestsManipulation.Lock()
-		request.Client.Requests[request.RequestID][type_id] = append(request.Client.Requests[request.RequestID][type_id], function)
+		if state, present := request.Client.Requests[request.RequestID]; present {
+			state.Callbacks[type_id] = append(state.Callbacks[type_id], function)
+		}
 		request.Client.RequestsManipulation.Unlock()
 	}
 }
+
+//
+// OnError is used to define the behaviors used when a request fails
+// before receiving any response, such as when it times out or is
+// cancelled, or when the server responds with an ErrorResponse.  An
+// ErrorResponse also removes the request from client.Requests.
+//
+func (request *Request) OnError(function func(error)) {
+	request.Client.RequestsManipulation.Lock()
+	if state, present := request.Client.Requests[request.RequestID]; present {
+		state.Failures = append(state.Failures, function)
+	}
+	request.Client.RequestsManipulation.Unlock()
+}
+
+//
+// Cancel removes the request from client.Requests so no further
+// responses will be handled, running any error callbacks with
+// ErrRequestCancelled if no response was received.  If
+// client.CancelRequests is set the server is sent a Cancel.
+//
+func (request *Request) Cancel() {
+	request.Client.failRequest(request.RequestID, ErrRequestCancelled)
+}
+
+//
+// Remove the request from client.Requests so no further responses
+// will be delivered to its callbacks, without running error callbacks.
+//
+func (request *Request) forget() {
+	request.Client.removeRequest(request.RequestID)
+}
+
+//
+// Remove the request from client.Requests without running error
+// callbacks, sending the server a Cancel if it was still outstanding.
+//
+func (request *Request) abandon() {
+	if state := request.Client.removeRequest(request.RequestID); state != nil && state.outstanding() {
+		request.Client.cancel(request.RequestID)
+	}
+}
@@ -1,6 +1,7 @@
 package tlb_test
 
 import (
+	"context"
 	"encoding/binary"
 	. "github.com/hkparker/TLB"
 	. "github.com/onsi/ginkgo"
@@ -88,6 +89,194 @@ var _ = Describe("Client", func() {
 		})
 	})
 
+	Describe("RequestContext", func() {
+		It("returns the response to the request", func() {
+			listener, err := net.Listen("tcp", "localhost:0")
+			Expect(err).To(BeNil())
+			defer listener.Close()
+			server := NewServer(listener, TagSocketAll, populated_type_store)
+			server.AcceptRequest("all", reflect.TypeOf(Thingy{}), func(iface interface{}, context TLBContext) {
+				context.Respond(Thingy{
+					ID:   2,
+					Name: "response!",
+				})
+			})
+			client_socket, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).To(BeNil())
+			defer client_socket.Close()
+			client := NewClient(client_socket, populated_type_store, false)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			iface, err := client.RequestContext(ctx, thingy, reflect.TypeOf(Thingy{}))
+			Expect(err).To(BeNil())
+			if response, correct_type := iface.(*Thingy); correct_type {
+				Expect(response.ID).To(Equal(2))
+				Expect(response.Name).To(Equal("response!"))
+			} else {
+				Expect(correct_type).To(Equal(true))
+			}
+			Expect(len(client.Requests)).To(Equal(0))
+		})
+
+		It("returns the context error and forgets the request when cancelled", func() {
+			listener, err := net.Listen("tcp", "localhost:0")
+			Expect(err).To(BeNil())
+			defer listener.Close()
+			NewServer(listener, TagSocketAll, populated_type_store)
+			client_socket, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).To(BeNil())
+			defer client_socket.Close()
+			client := NewClient(client_socket, populated_type_store, false)
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			iface, err := client.RequestContext(ctx, thingy, reflect.TypeOf(Thingy{}))
+			Expect(iface).To(BeNil())
+			Expect(err).To(Equal(context.DeadlineExceeded))
+			Expect(len(client.Requests)).To(Equal(0))
+		})
+	})
+
+	Describe("RequestTimeout", func() {
+		It("fails and forgets requests that receive no response", func() {
+			listener, err := net.Listen("tcp", "localhost:0")
+			Expect(err).To(BeNil())
+			defer listener.Close()
+			NewServer(listener, TagSocketAll, populated_type_store)
+			client_socket, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).To(BeNil())
+			defer client_socket.Close()
+			client := NewClient(client_socket, populated_type_store, false)
+			client.RequestTimeout = 100 * time.Millisecond
+			request, err := client.Request(thingy)
+			Expect(err).To(BeNil())
+			errors := make(chan error, 1)
+			request.OnError(func(err error) {
+				errors <- err
+			})
+			Expect(<-errors).To(Equal(ErrRequestTimeout))
+			Expect(len(client.Requests)).To(Equal(0))
+		})
+	})
+
+	Describe("Cancel", func() {
+		It("fails and forgets the request", func() {
+			listener, err := net.Listen("tcp", "localhost:0")
+			Expect(err).To(BeNil())
+			defer listener.Close()
+			NewServer(listener, TagSocketAll, populated_type_store)
+			client_socket, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).To(BeNil())
+			defer client_socket.Close()
+			client := NewClient(client_socket, populated_type_store, false)
+			request, err := client.Request(thingy)
+			Expect(err).To(BeNil())
+			errors := make(chan error, 1)
+			request.OnError(func(err error) {
+				errors <- err
+			})
+			request.Cancel()
+			Expect(<-errors).To(Equal(ErrRequestCancelled))
+			Expect(len(client.Requests)).To(Equal(0))
+		})
+	})
+
+	Describe("WideRequestIDs", func() {
+		It("sends and receives responses in wide capsules", func() {
+			listener, err := net.Listen("tcp", "localhost:0")
+			Expect(err).To(BeNil())
+			defer listener.Close()
+			server := NewServer(listener, TagSocketAll, populated_type_store)
+			server.AcceptRequest("all", reflect.TypeOf(Thingy{}), func(iface interface{}, context TLBContext) {
+				context.Respond(Thingy{
+					ID:   2,
+					Name: "wide",
+				})
+			})
+			client_socket, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).To(BeNil())
+			defer client_socket.Close()
+			client := NewClient(client_socket, populated_type_store, false)
+			client.WideRequestIDs = true
+			client.NextID = 70000
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			iface, err := client.RequestContext(ctx, thingy, reflect.TypeOf(Thingy{}))
+			Expect(err).To(BeNil())
+			if response, correct_type := iface.(*Thingy); correct_type {
+				Expect(response.Name).To(Equal("wide"))
+			} else {
+				Expect(correct_type).To(Equal(true))
+			}
+		})
+
+		It("wraps around without reusing outstanding request IDs", func() {
+			listener, err := net.Listen("tcp", "localhost:0")
+			Expect(err).To(BeNil())
+			defer listener.Close()
+			NewServer(listener, TagSocketAll, populated_type_store)
+			client_socket, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).To(BeNil())
+			defer client_socket.Close()
+			client := NewClient(client_socket, populated_type_store, false)
+			first, err := client.Request(thingy)
+			Expect(err).To(BeNil())
+			Expect(first.RequestID).To(Equal(uint32(1)))
+			client.NextID = 65535
+			last, err := client.Request(thingy)
+			Expect(err).To(BeNil())
+			Expect(last.RequestID).To(Equal(uint32(65535)))
+			wrapped, err := client.Request(thingy)
+			Expect(err).To(BeNil())
+			Expect(wrapped.RequestID).To(Equal(uint32(2)))
+		})
+	})
+
+	Describe("Close", func() {
+		It("fails outstanding requests and reports the client is done", func() {
+			listener, err := net.Listen("tcp", "localhost:0")
+			Expect(err).To(BeNil())
+			defer listener.Close()
+			NewServer(listener, TagSocketAll, populated_type_store)
+			client_socket, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).To(BeNil())
+			client := NewClient(client_socket, populated_type_store, false)
+			request, err := client.Request(thingy)
+			Expect(err).To(BeNil())
+			errors := make(chan error, 1)
+			request.OnError(func(err error) {
+				errors <- err
+			})
+			Expect(client.Err()).To(BeNil())
+			err = client.Close()
+			Expect(err).To(BeNil())
+			<-client.Done()
+			Expect(client.Err()).To(Equal(ErrConnectionClosed))
+			Expect(<-errors).To(Equal(ErrConnectionClosed))
+			Expect(len(client.Requests)).To(Equal(0))
+			_, err = client.Request(thingy)
+			Expect(err).To(Equal(ErrConnectionClosed))
+		})
+
+		It("is done with the read error when the server goes away", func() {
+			listener, err := net.Listen("tcp", "localhost:0")
+			Expect(err).To(BeNil())
+			defer listener.Close()
+			sockets := make(chan net.Conn, 1)
+			go func() {
+				conn, _ := listener.Accept()
+				sockets <- conn
+			}()
+			client_socket, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).To(BeNil())
+			client := NewClient(client_socket, populated_type_store, false)
+			server_side := <-sockets
+			server_side.Close()
+			<-client.Done()
+			Expect(client.Err()).ToNot(BeNil())
+			Expect(client.Err()).ToNot(Equal(ErrConnectionClosed))
+		})
+	})
+
 	Describe("StreamWriter", func() {
 		Describe("Write", func() {
 			It("outputs the correct format", func() {
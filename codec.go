@@ -0,0 +1,132 @@
+package tlb
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"github.com/vmihailenco/msgpack/v5"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//
+// A Codec serializes structs to and from the payload of the TLV
+// protocol.  Every TypeStore uses one Codec for all structs except
+// Hellos, which are always BSON so peers using different Codecs can
+// still tell each other apart.  The ID is exchanged during handshakes.
+//
+type Codec interface {
+	ID() string
+	Marshal(interface{}) ([]byte, error)
+	Unmarshal([]byte, interface{}) error
+}
+
+//
+// BSONCodec serializes structs with BSON, and is the Codec used by
+// NewTypeStore.
+//
+type BSONCodec struct{}
+
+//
+// ID names the BSON Codec during handshakes.
+//
+func (BSONCodec) ID() string {
+	return "bson"
+}
+
+//
+// Marshal serializes a struct as BSON.
+//
+func (BSONCodec) Marshal(instance interface{}) ([]byte, error) {
+	return bson.Marshal(instance)
+}
+
+//
+// Unmarshal fills a struct from BSON data.
+//
+func (BSONCodec) Unmarshal(data []byte, instance interface{}) error {
+	return bson.Unmarshal(data, instance)
+}
+
+//
+// JSONCodec serializes structs with encoding/json, which is slower
+// than BSON but easy to read when debugging.
+//
+type JSONCodec struct{}
+
+//
+// ID names the JSON Codec during handshakes.
+//
+func (JSONCodec) ID() string {
+	return "json"
+}
+
+//
+// Marshal serializes a struct as JSON.
+//
+func (JSONCodec) Marshal(instance interface{}) ([]byte, error) {
+	return json.Marshal(instance)
+}
+
+//
+// Unmarshal fills a struct from JSON data.
+//
+func (JSONCodec) Unmarshal(data []byte, instance interface{}) error {
+	return json.Unmarshal(data, instance)
+}
+
+//
+// GobCodec serializes structs with encoding/gob.  Each struct is
+// encoded on its own, so type information is repeated in every
+// payload.
+//
+type GobCodec struct{}
+
+//
+// ID names the gob Codec during handshakes.
+//
+func (GobCodec) ID() string {
+	return "gob"
+}
+
+//
+// Marshal serializes a struct as gob.
+//
+func (GobCodec) Marshal(instance interface{}) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	err := gob.NewEncoder(buffer).Encode(instance)
+	return buffer.Bytes(), err
+}
+
+//
+// Unmarshal fills a struct from gob data.
+//
+func (GobCodec) Unmarshal(data []byte, instance interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(instance)
+}
+
+//
+// MessagePackCodec serializes structs with MessagePack, producing
+// smaller payloads than BSON.
+//
+type MessagePackCodec struct{}
+
+//
+// ID names the MessagePack Codec during handshakes.
+//
+func (MessagePackCodec) ID() string {
+	return "msgpack"
+}
+
+//
+// Marshal serializes a struct as MessagePack.
+//
+func (MessagePackCodec) Marshal(instance interface{}) ([]byte, error) {
+	return msgpack.Marshal(instance)
+}
+
+//
+// Unmarshal fills a struct from MessagePack data.
+//
+func (MessagePackCodec) Unmarshal(data []byte, instance interface{}) error {
+	return msgpack.Unmarshal(data, instance)
+}
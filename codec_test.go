@@ -0,0 +1,95 @@
+package tlb_test
+
+import (
+	"context"
+	. "github.com/hkparker/TLB"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net"
+	"reflect"
+	"time"
+)
+
+func thingyBuilder(codec Codec) Builder {
+	return func(data []byte, _ TLBContext) interface{} {
+		thing := &Thingy{}
+		err := codec.Unmarshal(data, thing)
+		if err != nil {
+			return nil
+		}
+		return thing
+	}
+}
+
+var _ = Describe("Codec", func() {
+
+	var thingy Thingy
+
+	BeforeEach(func() {
+		thingy = Thingy{
+			Name: "test",
+			ID:   1,
+		}
+	})
+
+	It("can round trip structs with every built in codec", func() {
+		for _, codec := range []Codec{BSONCodec{}, JSONCodec{}, GobCodec{}, MessagePackCodec{}} {
+			data, err := codec.Marshal(thingy)
+			Expect(err).To(BeNil())
+			restored_thingy := &Thingy{}
+			err = codec.Unmarshal(data, restored_thingy)
+			Expect(err).To(BeNil())
+			Expect(*restored_thingy).To(Equal(thingy))
+		}
+	})
+
+	It("is used by the TypeStore for structs and capsules", func() {
+		type_store := NewTypeStoreWithCodec(JSONCodec{})
+		type_store.AddType(reflect.TypeOf(Thingy{}), reflect.TypeOf(&Thingy{}), thingyBuilder(JSONCodec{}))
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).To(BeNil())
+		defer listener.Close()
+		server := NewServer(listener, TagSocketAll, type_store)
+		server.AcceptRequest("all", reflect.TypeOf(Thingy{}), func(iface interface{}, context TLBContext) {
+			if received_thingy, correct_type := iface.(*Thingy); correct_type {
+				context.Respond(Thingy{
+					ID:   received_thingy.ID + 1,
+					Name: "json",
+				})
+			}
+		})
+		client_socket, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).To(BeNil())
+		defer client_socket.Close()
+		client := NewClient(client_socket, type_store, false)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = client.Handshake(ctx)
+		Expect(err).To(BeNil())
+		iface, err := client.RequestContext(ctx, thingy, reflect.TypeOf(Thingy{}))
+		Expect(err).To(BeNil())
+		if response, correct_type := iface.(*Thingy); correct_type {
+			Expect(response.ID).To(Equal(2))
+			Expect(response.Name).To(Equal("json"))
+		} else {
+			Expect(correct_type).To(Equal(true))
+		}
+	})
+
+	It("fails the handshake when peers use different codecs", func() {
+		server_type_store := NewTypeStoreWithCodec(GobCodec{})
+		client_type_store := NewTypeStoreWithCodec(MessagePackCodec{})
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).To(BeNil())
+		defer listener.Close()
+		NewServer(listener, TagSocketAll, server_type_store)
+		client_socket, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).To(BeNil())
+		defer client_socket.Close()
+		client := NewClient(client_socket, client_type_store, false)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = client.Handshake(ctx)
+		Expect(err).ToNot(BeNil())
+	})
+})
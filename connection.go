@@ -0,0 +1,167 @@
+package tlb
+
+import (
+	"net"
+	"sync"
+)
+
+//
+// A Connection is the server's record of a socket, owning the lock
+// held while writing to it so that responses, broadcasts and other
+// structs the server sends from different goroutines are never
+// interleaved.  Streams holds the Streams the other end of the socket
+// has opened, and Requests the requests whose callbacks are running so
+// they can be cancelled.  Writes use the write timeout of Heartbeat.
+// A Connection is created when the server accepts or tags a socket,
+// and forgotten once the server stops reading from the socket, or when
+// the socket is deleted if the server never read from it.
+//
+type Connection struct {
+	Socket               net.Conn
+	Writing              *sync.Mutex
+	Streams              map[uint32]*Stream
+	StreamsManipulation  *sync.Mutex
+	Requests             map[uint32]*RunningRequest
+	RequestsManipulation *sync.Mutex
+	Heartbeat            *Heartbeat
+	reading              bool
+	failure              error
+	failing              *sync.Mutex
+	writeDeadline        *bool
+	broadcasts           *broadcastQueue
+}
+
+//
+// Create a Connection for a socket that is written to while holding
+// writing.
+//
+func newConnection(socket net.Conn, writing *sync.Mutex, heartbeat *Heartbeat) *Connection {
+	return &Connection{
+		Socket:               socket,
+		Writing:              writing,
+		Streams:              make(map[uint32]*Stream),
+		StreamsManipulation:  &sync.Mutex{},
+		Requests:             make(map[uint32]*RunningRequest),
+		RequestsManipulation: &sync.Mutex{},
+		Heartbeat:            heartbeat,
+		failing:              &sync.Mutex{},
+		writeDeadline:        new(bool),
+		broadcasts: &broadcastQueue{
+			manipulation: &sync.Mutex{},
+		},
+	}
+}
+
+//
+// Write bytes to the Connection's socket while holding its lock.  If
+// the write timeout passes the socket is closed, since part of a struct
+// may have been written, and ErrIdleTimeout is returned.
+//
+func (connection *Connection) Write(data []byte) error {
+	connection.Writing.Lock()
+	connection.Heartbeat.setWriteDeadline(connection.Socket, connection.writeDeadline)
+	_, err := connection.Socket.Write(data)
+	connection.Writing.Unlock()
+	if idleError(err) == ErrIdleTimeout {
+		connection.Fail(ErrIdleTimeout)
+		return ErrIdleTimeout
+	}
+	return err
+}
+
+//
+// Fail closes the Connection's socket, recording err as the reason it
+// failed unless it already failed.
+//
+func (connection *Connection) Fail(err error) {
+	connection.failing.Lock()
+	if connection.failure == nil {
+		connection.failure = err
+	}
+	connection.failing.Unlock()
+	connection.Socket.Close()
+}
+
+//
+// Return why reading from the Connection's socket failed with err,
+// which is the reason given to connection.Fail if it was called.
+//
+func (connection *Connection) reason(err error) error {
+	connection.failing.Lock()
+	defer connection.failing.Unlock()
+	if connection.failure != nil {
+		return connection.failure
+	}
+	return idleError(err)
+}
+
+//
+// Return the Connection for a socket, or nil if the server has not
+// accepted or tagged the socket or has since forgotten it.
+//
+func (server *Server) Connection(socket net.Conn) *Connection {
+	server.TagManipulation.Lock()
+	defer server.TagManipulation.Unlock()
+	return server.Connections[socket]
+}
+
+//
+// Return the Connection for a socket, creating it if the server does
+// not have one.  Must be called while holding server.TagManipulation.
+//
+func (server *Server) addConnection(socket net.Conn) *Connection {
+	connection, present := server.Connections[socket]
+	if !present {
+		connection = newConnection(socket, &sync.Mutex{}, server.Heartbeat)
+		server.Connections[socket] = connection
+	}
+	return connection
+}
+
+//
+// Forget the Connection for a socket once it has been closed, failing
+// any Streams still open on it and cancelling its running requests.
+//
+func (server *Server) removeConnection(socket net.Conn) {
+	server.TagManipulation.Lock()
+	connection := server.Connections[socket]
+	delete(server.Connections, socket)
+	server.TagManipulation.Unlock()
+	if connection == nil {
+		return
+	}
+	connection.StreamsManipulation.Lock()
+	streams := make([]*Stream, 0, len(connection.Streams))
+	for _, stream := range connection.Streams {
+		streams = append(streams, stream)
+	}
+	connection.StreamsManipulation.Unlock()
+	for _, stream := range streams {
+		stream.fail(ErrConnectionClosed)
+	}
+	connection.RequestsManipulation.Lock()
+	for request_id, running := range connection.Requests {
+		running.Cancel()
+		delete(connection.Requests, request_id)
+	}
+	connection.RequestsManipulation.Unlock()
+}
+
+//
+// Write bytes to a socket through its Connection, removing the socket
+// from the server if the write fails.  A socket closed because the
+// write timed out is removed once reading from it fails.  Sockets the
+// server has not accepted or tagged, or has already forgotten, are
+// written to directly without giving them a Connection.
+//
+func (server *Server) write(socket net.Conn, data []byte) error {
+	connection := server.Connection(socket)
+	if connection == nil {
+		connection = newConnection(socket, &sync.Mutex{}, server.Heartbeat)
+	}
+	err := connection.Write(data)
+	if err != nil && err != ErrIdleTimeout {
+		server.dropSocket(socket, err)
+	}
+	return err
+}
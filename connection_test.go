@@ -0,0 +1,125 @@
+package tlb_test
+
+import (
+	"context"
+	"errors"
+	. "github.com/hkparker/TLB"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ = Describe("Connection", func() {
+
+	var type_store TypeStore
+
+	BeforeEach(func() {
+		type_store = NewTypeStore()
+		type_store.AddType(reflect.TypeOf(Thingy{}), reflect.TypeOf(&Thingy{}), BuildThingy)
+	})
+
+	It("is the same for every write to a socket", func() {
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).To(BeNil())
+		defer listener.Close()
+		server := NewServer(listener, TagSocketAll, type_store)
+		socket, other := net.Pipe()
+		defer socket.Close()
+		defer other.Close()
+		server.TagSocket(socket, "all")
+		Expect(server.Connection(socket)).To(BeIdenticalTo(server.Connection(socket)))
+		Expect(server.Connection(socket).Socket).To(Equal(socket))
+	})
+
+	It("is not created for sockets the server does not know", func() {
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).To(BeNil())
+		defer listener.Close()
+		server := NewServer(listener, TagSocketAll, type_store)
+		socket, other := net.Pipe()
+		other.Close()
+		socket.Close()
+		Expect(server.Send(socket, Thingy{})).ToNot(BeNil())
+		Expect(server.Connection(socket)).To(BeNil())
+	})
+
+	It("is forgotten once the socket closes", func() {
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).To(BeNil())
+		defer listener.Close()
+		server := NewServer(listener, TagSocketAll, type_store)
+		sockets := make(chan net.Conn, 1)
+		server.Accept("all", reflect.TypeOf(Thingy{}), func(_ interface{}, context TLBContext) {
+			sockets <- context.Socket
+		})
+		client_socket, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).To(BeNil())
+		client := NewClient(client_socket, type_store, false)
+		Expect(client.Message(Thingy{})).To(BeNil())
+		var socket net.Conn
+		Eventually(sockets).Should(Receive(&socket))
+		Expect(server.Connection(socket)).ToNot(BeNil())
+		client.Close()
+		Eventually(func() *Connection {
+			return server.Connection(socket)
+		}).Should(BeNil())
+		Expect(server.Send(socket, Thingy{})).ToNot(BeNil())
+		Expect(server.Broadcast("all", Thingy{})).To(BeNil())
+		Expect(server.Connection(socket)).To(BeNil())
+	})
+
+	It("is forgotten when a socket the server does not read is deleted", func() {
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).To(BeNil())
+		defer listener.Close()
+		server := NewServer(listener, TagSocketAll, type_store)
+		socket, other := net.Pipe()
+		defer socket.Close()
+		defer other.Close()
+		server.TagSocket(socket, "all")
+		Expect(server.Connection(socket)).ToNot(BeNil())
+		server.Delete(socket)
+		Expect(server.Connection(socket)).To(BeNil())
+	})
+
+	It("keeps concurrent responses on one socket from interleaving", func() {
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).To(BeNil())
+		defer listener.Close()
+		server := NewServer(listener, TagSocketAll, type_store)
+		large := strings.Repeat("x", 256*1024)
+		server.AcceptRequest("all", reflect.TypeOf(Thingy{}), func(iface interface{}, context TLBContext) {
+			if thingy, correct_type := iface.(*Thingy); correct_type {
+				context.Respond(Thingy{Name: large, ID: thingy.ID})
+			}
+		})
+		client_socket, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).To(BeNil())
+		defer client_socket.Close()
+		client := NewClient(client_socket, type_store, false)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		errs := make(chan error, 20)
+		var requests sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			requests.Add(1)
+			go func(id int) {
+				defer requests.Done()
+				iface, err := client.RequestContext(ctx, Thingy{ID: id}, reflect.TypeOf(Thingy{}))
+				if err == nil && iface.(*Thingy).ID != id {
+					err = errors.New("response for the wrong request")
+				}
+				errs <- err
+			}(i)
+		}
+		requests.Wait()
+		close(errs)
+		for err := range errs {
+			Expect(err).To(BeNil())
+		}
+	})
+})
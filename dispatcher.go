@@ -0,0 +1,309 @@
+package tlb
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+//
+// Errors returned by dispatcher.Submit when a callback is not run.
+// ErrQueueOverflow means the connection should be closed.
+//
+var (
+	ErrQueueFull         = errors.New("connection callback queue full")
+	ErrQueueOverflow     = errors.New("connection callback queue overflowed")
+	ErrDispatcherStopped = errors.New("dispatcher stopped")
+)
+
+//
+// What a Dispatcher does with a callback when its connection already
+// has QueueLimit callbacks waiting or running.  OverflowBlock makes the
+// connection's reader wait, so the peer feels backpressure,
+// OverflowDrop discards the callback, and OverflowDisconnect discards
+// it and closes the connection.
+//
+type OverflowPolicy int
+
+const (
+	OverflowBlock OverflowPolicy = iota
+	OverflowDrop
+	OverflowDisconnect
+)
+
+//
+// A Dispatcher runs the callbacks for structs received on connections.
+// With no Workers every callback gets its own goroutine, otherwise that
+// many goroutines take callbacks from a shared queue.  A QueueLimit
+// above zero caps how many callbacks each connection can have waiting
+// or running, applying Overflow once the cap is reached.
+//
+type Dispatcher struct {
+	Workers      int
+	QueueLimit   int
+	Overflow     OverflowPolicy
+	Manipulation *sync.Mutex
+	Changed      *sync.Cond
+	queue        []func()
+	depths       map[net.Conn]int
+	ordered      map[net.Conn][]func()
+	running      int
+	started      int
+	dropped      uint64
+	disconnected uint64
+	stopped      bool
+}
+
+//
+// A snapshot of a Dispatcher's queues.  Queued callbacks are waiting
+// for a worker, Running callbacks have started, and Dropped and
+// Disconnected count the callbacks discarded by each OverflowPolicy.
+//
+type DispatcherStats struct {
+	Queued       int
+	Running      int
+	Connections  int
+	MaxDepth     int
+	Dropped      uint64
+	Disconnected uint64
+}
+
+//
+// Create a Dispatcher that runs every callback in its own goroutine
+// with no limits, the behavior of Servers and Clients that are never
+// configured otherwise.
+//
+func NewDispatcher() *Dispatcher {
+	manipulation := &sync.Mutex{}
+	return &Dispatcher{
+		Manipulation: manipulation,
+		Changed:      sync.NewCond(manipulation),
+		depths:       make(map[net.Conn]int),
+		ordered:      make(map[net.Conn][]func()),
+	}
+}
+
+//
+// Configure sets the number of workers, the per-connection queue limit
+// and the overflow policy.  Workers that are already running are kept,
+// so the pool can grow but not shrink.
+//
+func (dispatcher *Dispatcher) Configure(workers, queue_limit int, overflow OverflowPolicy) {
+	dispatcher.Manipulation.Lock()
+	defer dispatcher.Manipulation.Unlock()
+	dispatcher.Workers = workers
+	dispatcher.QueueLimit = queue_limit
+	dispatcher.Overflow = overflow
+	for dispatcher.started < workers {
+		dispatcher.started++
+		go dispatcher.work()
+	}
+	dispatcher.Changed.Broadcast()
+}
+
+//
+// Submit a callback received on a connection.  If the connection's
+// queue is full the callback is discarded and ErrQueueFull is returned
+// under OverflowDrop, or ErrQueueOverflow under OverflowDisconnect.
+//
+func (dispatcher *Dispatcher) Submit(socket net.Conn, job func()) error {
+	return dispatcher.submit(socket, job, false)
+}
+
+//
+// SubmitOrdered is Submit for callbacks that must run one at a time in
+// the order they were received.  Each connection has one sequence of
+// ordered callbacks, which runs alongside its unordered callbacks.
+//
+func (dispatcher *Dispatcher) SubmitOrdered(socket net.Conn, job func()) error {
+	return dispatcher.submit(socket, job, true)
+}
+
+func (dispatcher *Dispatcher) submit(socket net.Conn, job func(), ordered bool) error {
+	dispatcher.Manipulation.Lock()
+	defer dispatcher.Manipulation.Unlock()
+	for !dispatcher.stopped && dispatcher.full(socket) {
+		switch dispatcher.Overflow {
+		case OverflowDrop:
+			dispatcher.dropped++
+			return ErrQueueFull
+		case OverflowDisconnect:
+			dispatcher.disconnected++
+			return ErrQueueOverflow
+		}
+		dispatcher.Changed.Wait()
+	}
+	if dispatcher.stopped {
+		return ErrDispatcherStopped
+	}
+	dispatcher.depths[socket]++
+	wrapped := func() {
+		defer dispatcher.finish(socket, ordered)
+		job()
+	}
+	if !ordered {
+		dispatcher.enqueue(wrapped)
+		return nil
+	}
+	dispatcher.ordered[socket] = append(dispatcher.ordered[socket], wrapped)
+	if len(dispatcher.ordered[socket]) == 1 {
+		dispatcher.enqueue(wrapped)
+	}
+	return nil
+}
+
+//
+// Start a callback in its own goroutine, or queue it for a worker.
+// The caller must hold the lock.
+//
+func (dispatcher *Dispatcher) enqueue(job func()) {
+	if dispatcher.started == 0 {
+		dispatcher.running++
+		go job()
+		return
+	}
+	dispatcher.queue = append(dispatcher.queue, job)
+	dispatcher.Changed.Broadcast()
+}
+
+//
+// Account for a finished callback, starting the next ordered callback
+// for the connection if there is one.
+//
+func (dispatcher *Dispatcher) finish(socket net.Conn, ordered bool) {
+	dispatcher.Manipulation.Lock()
+	defer dispatcher.Manipulation.Unlock()
+	dispatcher.running--
+	dispatcher.depths[socket]--
+	if dispatcher.depths[socket] <= 0 {
+		delete(dispatcher.depths, socket)
+	}
+	if ordered {
+		sequence := dispatcher.ordered[socket]
+		sequence[0] = nil
+		sequence = sequence[1:]
+		if len(sequence) == 0 {
+			delete(dispatcher.ordered, socket)
+		} else {
+			dispatcher.ordered[socket] = sequence
+			dispatcher.enqueue(sequence[0])
+		}
+	}
+	dispatcher.Changed.Broadcast()
+}
+
+//
+// Report if a connection has as many callbacks as it is allowed.
+//
+func (dispatcher *Dispatcher) full(socket net.Conn) bool {
+	return dispatcher.QueueLimit > 0 && dispatcher.depths[socket] >= dispatcher.QueueLimit
+}
+
+//
+// Workers run work in a goroutine to take callbacks from the queue
+// until the Dispatcher is stopped and the queue is empty.
+//
+func (dispatcher *Dispatcher) work() {
+	dispatcher.Manipulation.Lock()
+	for {
+		for len(dispatcher.queue) == 0 && !dispatcher.stopped {
+			dispatcher.Changed.Wait()
+		}
+		if len(dispatcher.queue) == 0 {
+			dispatcher.started--
+			dispatcher.Manipulation.Unlock()
+			return
+		}
+		job := dispatcher.queue[0]
+		dispatcher.queue[0] = nil
+		dispatcher.queue = dispatcher.queue[1:]
+		dispatcher.running++
+		dispatcher.Manipulation.Unlock()
+		job()
+		dispatcher.Manipulation.Lock()
+	}
+}
+
+//
+// Depth returns how many callbacks a connection has waiting or running.
+//
+func (dispatcher *Dispatcher) Depth(socket net.Conn) int {
+	dispatcher.Manipulation.Lock()
+	defer dispatcher.Manipulation.Unlock()
+	return dispatcher.depths[socket]
+}
+
+//
+// Stats returns a snapshot of the Dispatcher's queues.
+//
+func (dispatcher *Dispatcher) Stats() DispatcherStats {
+	dispatcher.Manipulation.Lock()
+	defer dispatcher.Manipulation.Unlock()
+	stats := DispatcherStats{
+		Queued:       len(dispatcher.queue),
+		Running:      dispatcher.running,
+		Connections:  len(dispatcher.depths),
+		Dropped:      dispatcher.dropped,
+		Disconnected: dispatcher.disconnected,
+	}
+	for _, depth := range dispatcher.depths {
+		if depth > stats.MaxDepth {
+			stats.MaxDepth = depth
+		}
+	}
+	return stats
+}
+
+//
+// Stop refuses new callbacks and lets the workers exit once the queue
+// is empty.  Callbacks already submitted still run.
+//
+func (dispatcher *Dispatcher) Stop() {
+	dispatcher.Manipulation.Lock()
+	dispatcher.stopped = true
+	dispatcher.Changed.Broadcast()
+	dispatcher.Manipulation.Unlock()
+}
+
+//
+// An Ordering records which types of struct must be delivered in order.
+// If All is set every type is, otherwise only the codes in Types.
+//
+type Ordering struct {
+	All          bool
+	Types        map[uint16]bool
+	Manipulation *sync.Mutex
+}
+
+//
+// Create an Ordering that covers no types.
+//
+func NewOrdering() *Ordering {
+	return &Ordering{
+		Types:        make(map[uint16]bool),
+		Manipulation: &sync.Mutex{},
+	}
+}
+
+//
+// Add type codes to the Ordering, or every type if no codes are given.
+//
+func (ordering *Ordering) add(codes []uint16) {
+	ordering.Manipulation.Lock()
+	defer ordering.Manipulation.Unlock()
+	if len(codes) == 0 {
+		ordering.All = true
+	}
+	for _, code := range codes {
+		ordering.Types[code] = true
+	}
+}
+
+//
+// Covers reports if structs with a type code must be delivered in order.
+//
+func (ordering *Ordering) Covers(code uint16) bool {
+	ordering.Manipulation.Lock()
+	defer ordering.Manipulation.Unlock()
+	return ordering.All || ordering.Types[code]
+}
@@ -0,0 +1,177 @@
+package tlb_test
+
+import (
+	. "github.com/hkparker/TLB"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+var _ = Describe("Dispatcher", func() {
+
+	var (
+		dispatcher *Dispatcher
+		socket     net.Conn
+		other      net.Conn
+		release    chan struct{}
+	)
+
+	BeforeEach(func() {
+		dispatcher = NewDispatcher()
+		socket, other = net.Pipe()
+		release = make(chan struct{})
+	})
+
+	AfterEach(func() {
+		dispatcher.Stop()
+		socket.Close()
+		other.Close()
+	})
+
+	waitFor := func(release chan struct{}) func() {
+		return func() {
+			<-release
+		}
+	}
+
+	It("runs no more callbacks at once than it has workers", func() {
+		dispatcher.Configure(2, 0, OverflowBlock)
+		for i := 0; i < 10; i++ {
+			Expect(dispatcher.Submit(socket, waitFor(release))).To(BeNil())
+		}
+		Eventually(func() int {
+			return dispatcher.Stats().Running
+		}).Should(Equal(2))
+		stats := dispatcher.Stats()
+		Expect(stats.Queued).To(Equal(8))
+		Expect(stats.MaxDepth).To(Equal(10))
+		Expect(dispatcher.Depth(socket)).To(Equal(10))
+		close(release)
+		Eventually(func() int {
+			return dispatcher.Depth(socket)
+		}).Should(Equal(0))
+	})
+
+	It("drops callbacks once a connection's queue is full", func() {
+		dispatcher.Configure(1, 2, OverflowDrop)
+		Expect(dispatcher.Submit(socket, waitFor(release))).To(BeNil())
+		Expect(dispatcher.Submit(socket, waitFor(release))).To(BeNil())
+		Expect(dispatcher.Submit(socket, waitFor(release))).To(Equal(ErrQueueFull))
+		Expect(dispatcher.Submit(other, waitFor(release))).To(BeNil())
+		Expect(dispatcher.Stats().Dropped).To(Equal(uint64(1)))
+		close(release)
+	})
+
+	It("returns ErrQueueOverflow when set to disconnect", func() {
+		dispatcher.Configure(1, 1, OverflowDisconnect)
+		Expect(dispatcher.Submit(socket, waitFor(release))).To(BeNil())
+		Expect(dispatcher.Submit(socket, waitFor(release))).To(Equal(ErrQueueOverflow))
+		Expect(dispatcher.Stats().Disconnected).To(Equal(uint64(1)))
+		close(release)
+	})
+
+	It("blocks submitting until a connection's queue has room", func() {
+		dispatcher.Configure(0, 1, OverflowBlock)
+		Expect(dispatcher.Submit(socket, waitFor(release))).To(BeNil())
+		submitted := make(chan error)
+		go func() {
+			submitted <- dispatcher.Submit(socket, func() {})
+		}()
+		Consistently(submitted, 50*time.Millisecond).ShouldNot(Receive())
+		close(release)
+		Eventually(submitted).Should(Receive(BeNil()))
+	})
+
+	It("runs ordered callbacks one at a time in order", func() {
+		dispatcher.Configure(4, 0, OverflowBlock)
+		order := make(chan int, 20)
+		var running, overlapped int32
+		for i := 0; i < 20; i++ {
+			position := i
+			Expect(dispatcher.SubmitOrdered(socket, func() {
+				if atomic.AddInt32(&running, 1) != 1 {
+					atomic.StoreInt32(&overlapped, 1)
+				}
+				time.Sleep(time.Millisecond)
+				order <- position
+				atomic.AddInt32(&running, -1)
+			})).To(BeNil())
+		}
+		for i := 0; i < 20; i++ {
+			Eventually(order).Should(Receive(Equal(i)))
+		}
+		Expect(atomic.LoadInt32(&overlapped)).To(Equal(int32(0)))
+	})
+
+	It("refuses callbacks once stopped", func() {
+		dispatcher.Stop()
+		Expect(dispatcher.Submit(socket, func() {})).To(Equal(ErrDispatcherStopped))
+	})
+
+	It("makes a server close sockets that overflow their queue", func() {
+		type_store := NewTypeStore()
+		type_store.AddType(reflect.TypeOf(Thingy{}), reflect.TypeOf(&Thingy{}), BuildThingy)
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).To(BeNil())
+		defer listener.Close()
+		server := NewServer(listener, TagSocketAll, type_store)
+		server.Dispatcher.Configure(1, 1, OverflowDisconnect)
+		wait := waitFor(release)
+		server.Accept("all", reflect.TypeOf(Thingy{}), func(_ interface{}, _ TLBContext) {
+			wait()
+		})
+		client_socket, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).To(BeNil())
+		defer client_socket.Close()
+		client := NewClient(client_socket, type_store, false)
+		for i := 0; i < 3; i++ {
+			client.Message(Thingy{ID: i})
+		}
+		Eventually(server.FailedSockets).Should(Receive())
+		close(release)
+	})
+
+	It("makes a server deliver structs in order when asked", func() {
+		type_store := NewTypeStore()
+		type_store.AddType(reflect.TypeOf(Thingy{}), reflect.TypeOf(&Thingy{}), BuildThingy)
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).To(BeNil())
+		defer listener.Close()
+		server := NewServer(listener, TagSocketAll, type_store)
+		Expect(server.InOrder("all", reflect.TypeOf(Thingy{}))).To(BeNil())
+		order := make(chan int, 20)
+		server.Accept("all", reflect.TypeOf(Thingy{}), func(iface interface{}, _ TLBContext) {
+			if thingy, correct_type := iface.(*Thingy); correct_type {
+				time.Sleep(time.Duration(20-thingy.ID) * 100 * time.Microsecond)
+				order <- thingy.ID
+			}
+		})
+		client_socket, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).To(BeNil())
+		defer client_socket.Close()
+		client := NewClient(client_socket, type_store, false)
+		for i := 0; i < 20; i++ {
+			Expect(client.Message(Thingy{ID: i})).To(BeNil())
+		}
+		for i := 0; i < 20; i++ {
+			Eventually(order).Should(Receive(Equal(i)))
+		}
+	})
+
+	It("returns an error when ordering a type not in the type store", func() {
+		type_store := NewTypeStore()
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).To(BeNil())
+		defer listener.Close()
+		server := NewServer(listener, TagSocketAll, type_store)
+		Expect(server.InOrder("all", reflect.TypeOf(Thingy{}))).ToNot(BeNil())
+		Expect(server.Ordered["all"]).To(BeNil())
+		client := NewClient(socket, type_store, true)
+		Expect(client.InOrder(reflect.TypeOf(Thingy{}))).ToNot(BeNil())
+		Expect(client.InOrder()).To(BeNil())
+		Expect(client.Ordered.All).To(BeTrue())
+	})
+})
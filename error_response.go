@@ -0,0 +1,25 @@
+package tlb
+
+import (
+	"fmt"
+)
+
+//
+// An ErrorResponse is sent in place of a response when a request
+// handler fails, using context.RespondError.  Clients receive it as
+// the error passed to request.OnError callbacks and returned from
+// client.RequestContext.  The meaning of Code is left to the
+// application, and Details is nil when no details were sent.
+//
+type ErrorResponse struct {
+	Code    int
+	Message string
+	Details map[string]string
+}
+
+//
+// Error allows an ErrorResponse to be used as an error.
+//
+func (response ErrorResponse) Error() string {
+	return fmt.Sprintf("error response %d: %s", response.Code, response.Message)
+}
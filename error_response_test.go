@@ -0,0 +1,106 @@
+package tlb_test
+
+import (
+	"context"
+	"errors"
+	. "github.com/hkparker/TLB"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net"
+	"reflect"
+	"time"
+)
+
+var _ = Describe("ErrorResponse", func() {
+
+	var (
+		populated_type_store TypeStore
+		thingy               Thingy
+	)
+
+	BeforeEach(func() {
+		populated_type_store = NewTypeStore()
+		populated_type_store.AddType(reflect.TypeOf(Thingy{}), reflect.TypeOf(&Thingy{}), BuildThingy)
+		thingy = Thingy{
+			Name: "test",
+			ID:   1,
+		}
+	})
+
+	request := func(respond func(TLBContext)) error {
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).To(BeNil())
+		defer listener.Close()
+		server := NewServer(listener, TagSocketAll, populated_type_store)
+		server.AcceptRequest("all", reflect.TypeOf(Thingy{}), func(_ interface{}, context TLBContext) {
+			respond(context)
+		})
+		client_socket, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).To(BeNil())
+		defer client_socket.Close()
+		client := NewClient(client_socket, populated_type_store, false)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = client.RequestContext(ctx, thingy, reflect.TypeOf(Thingy{}))
+		Expect(len(client.Requests)).To(Equal(0))
+		return err
+	}
+
+	It("is returned as the error from RequestContext", func() {
+		err := request(func(context TLBContext) {
+			context.RespondError(ErrorResponse{
+				Code:    404,
+				Message: "no such thingy",
+				Details: map[string]string{"id": "1"},
+			})
+		})
+		var response ErrorResponse
+		Expect(errors.As(err, &response)).To(Equal(true))
+		Expect(response.Code).To(Equal(404))
+		Expect(response.Message).To(Equal("no such thingy"))
+		Expect(response.Details["id"]).To(Equal("1"))
+	})
+
+	It("wraps other errors passed to RespondError", func() {
+		err := request(func(context TLBContext) {
+			context.RespondError(errors.New("failed"))
+		})
+		var response ErrorResponse
+		Expect(errors.As(err, &response)).To(Equal(true))
+		Expect(response.Code).To(Equal(0))
+		Expect(response.Message).To(Equal("failed"))
+	})
+
+	It("has nil Details when none were sent", func() {
+		err := request(func(context TLBContext) {
+			context.RespondError(ErrorResponse{
+				Code:    500,
+				Details: map[string]string{},
+			})
+		})
+		Expect(err).To(Equal(ErrorResponse{Code: 500}))
+	})
+
+	It("is passed to OnError callbacks", func() {
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).To(BeNil())
+		defer listener.Close()
+		server := NewServer(listener, TagSocketAll, populated_type_store)
+		err = OnRequest(&server, "all", func(_ *Thingy, _ TLBContext) (Thingy, error) {
+			time.Sleep(100 * time.Millisecond)
+			return Thingy{}, ErrorResponse{Code: 500, Message: "broken"}
+		})
+		Expect(err).To(BeNil())
+		client_socket, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).To(BeNil())
+		defer client_socket.Close()
+		client := NewClient(client_socket, populated_type_store, false)
+		request, err := client.Request(thingy)
+		Expect(err).To(BeNil())
+		failures := make(chan error, 1)
+		request.OnError(func(err error) {
+			failures <- err
+		})
+		Expect(<-failures).To(Equal(ErrorResponse{Code: 500, Message: "broken"}))
+	})
+})
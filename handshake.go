@@ -0,0 +1,203 @@
+package tlb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+//
+// ProtocolVersion is the version of the TLB protocol spoken by this
+// package, and MinProtocolVersion is the oldest version it will
+// complete a handshake with.
+//
+const (
+	ProtocolVersion    uint16 = 1
+	MinProtocolVersion uint16 = 1
+)
+
+//
+// Capabilities that can be advertised in a Hello.
+//
+const (
+	CapabilityWideRequestIDs = "wide-request-ids"
+	CapabilityNamedTypes     = "named-types"
+	CapabilityCancel         = "cancel"
+)
+
+//
+// Capabilities lists everything this package advertises to peers
+// during a handshake.
+//
+var Capabilities = []string{
+	CapabilityWideRequestIDs,
+	CapabilityNamedTypes,
+	CapabilityCancel,
+}
+
+//
+// A Hello is sent by a client at the start of a connection, and sent
+// back by the server with Reply set, to agree on a protocol version,
+// learn the peer's capabilities, check both sides use the same Codec,
+// and exchange the name and code of every type in each side's
+// TypeStore.  A server that rejects a Hello
+// sets Error in its reply and closes the connection.
+//
+type Hello struct {
+	Version      uint16
+	Capabilities []string
+	Codec        string
+	Fingerprint  string
+	Types        []NamedType
+	Reply        bool
+	Error        string
+}
+
+//
+// A NamedType pairs the name of a type with the code a TypeStore
+// uses for it on the network.
+//
+type NamedType struct {
+	Name string
+	Code uint16
+}
+
+//
+// A Handshake is the result of a successful Hello exchange, describing
+// the peer on the other end of a connection.  It is available to
+// callbacks and Builders as context.Handshake, which is nil if no
+// handshake took place.
+//
+type Handshake struct {
+	Version      uint16
+	Capabilities []string
+	Fingerprint  string
+	Codes        map[uint16]uint16
+}
+
+//
+// Supports reports if the peer advertised a capability.  A nil
+// Handshake supports nothing.
+//
+func (handshake *Handshake) Supports(capability string) bool {
+	if handshake == nil {
+		return false
+	}
+	for _, supported := range handshake.Capabilities {
+		if supported == capability {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// LocalCode translates a type code sent by the peer into the code the
+// local TypeStore uses for the same type, reporting false if the local
+// TypeStore has no type by that name.  Codes are used unchanged when
+// the peer did not send its types by name, and reserved codes are
+// never translated.
+//
+func (handshake *Handshake) LocalCode(remote_code uint16) (uint16, bool) {
+	if handshake == nil || handshake.Codes == nil {
+		return remote_code, true
+	}
+	if remote_code == CapsuleCode || remote_code >= MinReservedCode {
+		return remote_code, true
+	}
+	local_code, present := handshake.Codes[remote_code]
+	return local_code, present
+}
+
+//
+// Fingerprint returns a hash of every type code in the TypeStore and
+// the name of the type it identifies.  Two TypeStores with the same
+// fingerprint will interpret each other's structs the same way.
+//
+func (store *TypeStore) Fingerprint() string {
+	store.InsertType.Lock()
+	entries := make([]string, 0, len(store.Names))
+	for code, name := range store.Names {
+		entries = append(entries, fmt.Sprintf("%d %s", code, name))
+	}
+	store.InsertType.Unlock()
+	sort.Strings(entries)
+	hash := sha256.New()
+	for _, entry := range entries {
+		hash.Write([]byte(entry + "\n"))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+//
+// Create the Hello this TypeStore sends to a peer.
+//
+func (store *TypeStore) hello(reply bool) Hello {
+	store.InsertType.Lock()
+	types := make([]NamedType, 0, len(store.Names))
+	for code, name := range store.Names {
+		if code == CapsuleCode || code >= MinReservedCode {
+			continue
+		}
+		types = append(types, NamedType{
+			Name: name,
+			Code: code,
+		})
+	}
+	store.InsertType.Unlock()
+	return Hello{
+		Version:      ProtocolVersion,
+		Capabilities: Capabilities,
+		Codec:        store.Codec.ID(),
+		Fingerprint:  store.Fingerprint(),
+		Types:        types,
+		Reply:        reply,
+	}
+}
+
+//
+// Compare a Hello received from a peer against this TypeStore,
+// returning the resulting Handshake or an error describing why the
+// two sides cannot talk to each other.
+//
+func (store *TypeStore) negotiate(hello *Hello) (*Handshake, error) {
+	if hello.Error != "" {
+		return nil, errors.New("peer rejected handshake: " + hello.Error)
+	}
+	if hello.Version < MinProtocolVersion {
+		return nil, fmt.Errorf("peer protocol version %d is older than %d", hello.Version, MinProtocolVersion)
+	}
+	if hello.Codec != store.Codec.ID() {
+		return nil, fmt.Errorf("peer uses codec %q, not %q", hello.Codec, store.Codec.ID())
+	}
+	version := hello.Version
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	handshake := &Handshake{
+		Version:      version,
+		Capabilities: hello.Capabilities,
+		Fingerprint:  hello.Fingerprint,
+	}
+	if !handshake.Supports(CapabilityNamedTypes) {
+		if hello.Fingerprint != store.Fingerprint() {
+			return nil, errors.New("type store fingerprint does not match peer")
+		}
+		return handshake, nil
+	}
+	local_codes := make(map[string]uint16)
+	store.InsertType.Lock()
+	for code, name := range store.Names {
+		local_codes[name] = code
+	}
+	store.InsertType.Unlock()
+	handshake.Codes = make(map[uint16]uint16)
+	for _, named_type := range hello.Types {
+		if local_code, present := local_codes[named_type.Name]; present {
+			handshake.Codes[named_type.Code] = local_code
+		}
+	}
+	return handshake, nil
+}
@@ -0,0 +1,227 @@
+package tlb_test
+
+import (
+	"context"
+	. "github.com/hkparker/TLB"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/mgo.v2/bson"
+	"net"
+	"reflect"
+	"time"
+)
+
+type Gadget struct {
+	Size int
+}
+
+func BuildGadget(data []byte, _ TLBContext) interface{} {
+	gadget := &Gadget{}
+	err := bson.Unmarshal(data, &gadget)
+	if err != nil {
+		return nil
+	}
+	return gadget
+}
+
+var _ = Describe("Handshake", func() {
+
+	var (
+		type_store           TypeStore
+		populated_type_store TypeStore
+		thingy               Thingy
+	)
+
+	BeforeEach(func() {
+		type_store = NewTypeStore()
+		populated_type_store = NewTypeStore()
+		inst_type := reflect.TypeOf(Thingy{})
+		ptr_type := reflect.TypeOf(&Thingy{})
+		populated_type_store.AddType(inst_type, ptr_type, BuildThingy)
+		thingy = Thingy{
+			Name: "test",
+			ID:   1,
+		}
+	})
+
+	Describe("Fingerprint", func() {
+		It("matches for type stores built the same way", func() {
+			other_type_store := NewTypeStore()
+			other_type_store.AddType(reflect.TypeOf(Thingy{}), reflect.TypeOf(&Thingy{}), BuildThingy)
+			Expect(other_type_store.Fingerprint()).To(Equal(populated_type_store.Fingerprint()))
+		})
+
+		It("differs for type stores with different types", func() {
+			Expect(type_store.Fingerprint()).ToNot(Equal(populated_type_store.Fingerprint()))
+		})
+	})
+
+	Describe("Supports", func() {
+		It("reports advertised capabilities", func() {
+			handshake := &Handshake{
+				Capabilities: []string{CapabilityWideRequestIDs},
+			}
+			Expect(handshake.Supports(CapabilityWideRequestIDs)).To(Equal(true))
+			Expect(handshake.Supports("unknown")).To(Equal(false))
+		})
+
+		It("supports nothing when no handshake took place", func() {
+			var handshake *Handshake
+			Expect(handshake.Supports(CapabilityWideRequestIDs)).To(Equal(false))
+		})
+	})
+
+	Describe("Client.Handshake", func() {
+		It("negotiates with the server and exposes the result to callbacks", func() {
+			listener, err := net.Listen("tcp", "localhost:0")
+			Expect(err).To(BeNil())
+			defer listener.Close()
+			server := NewServer(listener, TagSocketAll, populated_type_store)
+			handshakes := make(chan *Handshake, 1)
+			server.Accept("all", reflect.TypeOf(Thingy{}), func(_ interface{}, context TLBContext) {
+				handshakes <- context.Handshake
+			})
+			client_socket, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).To(BeNil())
+			defer client_socket.Close()
+			client := NewClient(client_socket, populated_type_store, false)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			handshake, err := client.Handshake(ctx)
+			Expect(err).To(BeNil())
+			Expect(handshake.Version).To(Equal(ProtocolVersion))
+			Expect(handshake.Supports(CapabilityWideRequestIDs)).To(Equal(true))
+			Expect(client.WideRequestIDs).To(Equal(true))
+			err = client.Message(thingy)
+			Expect(err).To(BeNil())
+			server_handshake := <-handshakes
+			Expect(server_handshake).ToNot(BeNil())
+			Expect(server_handshake.Fingerprint).To(Equal(populated_type_store.Fingerprint()))
+		})
+
+		It("can run while requests are being made and timing out", func() {
+			listener, err := net.Listen("tcp", "localhost:0")
+			Expect(err).To(BeNil())
+			defer listener.Close()
+			NewServer(listener, TagSocketAll, populated_type_store)
+			client_socket, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).To(BeNil())
+			client := NewClient(client_socket, populated_type_store, false)
+			defer client.Close()
+			client.RequestTimeout = time.Millisecond
+			requested := make(chan bool)
+			go func() {
+				for i := 0; i < 20; i++ {
+					client.Request(thingy)
+					time.Sleep(time.Millisecond)
+				}
+				requested <- true
+			}()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_, err = client.Handshake(ctx)
+			Expect(err).To(BeNil())
+			Eventually(requested).Should(Receive())
+		})
+
+		It("fails when the type stores do not match and types are not named", func() {
+			capabilities := Capabilities
+			Capabilities = []string{CapabilityWideRequestIDs}
+			defer func() {
+				Capabilities = capabilities
+			}()
+			listener, err := net.Listen("tcp", "localhost:0")
+			Expect(err).To(BeNil())
+			defer listener.Close()
+			NewServer(listener, TagSocketAll, type_store)
+			client_socket, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).To(BeNil())
+			defer client_socket.Close()
+			client := NewClient(client_socket, populated_type_store, false)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			handshake, err := client.Handshake(ctx)
+			Expect(handshake).To(BeNil())
+			Expect(err).ToNot(BeNil())
+			Expect(client.WideRequestIDs).To(Equal(false))
+		})
+
+		It("maps type codes by name when types were added in a different order", func() {
+			server_type_store := NewTypeStore()
+			server_type_store.AddType(reflect.TypeOf(Gadget{}), reflect.TypeOf(&Gadget{}), BuildGadget)
+			server_type_store.AddType(reflect.TypeOf(Thingy{}), reflect.TypeOf(&Thingy{}), BuildThingy)
+			client_type_store := NewTypeStore()
+			client_type_store.AddType(reflect.TypeOf(Thingy{}), reflect.TypeOf(&Thingy{}), BuildThingy)
+			client_type_store.AddType(reflect.TypeOf(Gadget{}), reflect.TypeOf(&Gadget{}), BuildGadget)
+			listener, err := net.Listen("tcp", "localhost:0")
+			Expect(err).To(BeNil())
+			defer listener.Close()
+			server := NewServer(listener, TagSocketAll, server_type_store)
+			events := make(chan string, 1)
+			server.Accept("all", reflect.TypeOf(Thingy{}), func(iface interface{}, _ TLBContext) {
+				if received_thingy, correct_type := iface.(*Thingy); correct_type {
+					events <- received_thingy.Name
+				}
+			})
+			server.AcceptRequest("all", reflect.TypeOf(Thingy{}), func(_ interface{}, context TLBContext) {
+				context.Respond(Gadget{
+					Size: 3,
+				})
+			})
+			client_socket, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).To(BeNil())
+			defer client_socket.Close()
+			client := NewClient(client_socket, client_type_store, false)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			handshake, err := client.Handshake(ctx)
+			Expect(err).To(BeNil())
+			Expect(handshake.Supports(CapabilityNamedTypes)).To(Equal(true))
+			err = client.Message(thingy)
+			Expect(err).To(BeNil())
+			Expect(<-events).To(Equal("test"))
+			iface, err := client.RequestContext(ctx, thingy, reflect.TypeOf(Gadget{}))
+			Expect(err).To(BeNil())
+			if response, correct_type := iface.(*Gadget); correct_type {
+				Expect(response.Size).To(Equal(3))
+			} else {
+				Expect(correct_type).To(Equal(true))
+			}
+		})
+
+		It("skips structs of types the other end does not know", func() {
+			server_type_store := NewTypeStore()
+			server_type_store.AddType(reflect.TypeOf(Thingy{}), reflect.TypeOf(&Thingy{}), BuildThingy)
+			client_type_store := NewTypeStore()
+			client_type_store.AddType(reflect.TypeOf(Gadget{}), reflect.TypeOf(&Gadget{}), BuildGadget)
+			client_type_store.AddType(reflect.TypeOf(Thingy{}), reflect.TypeOf(&Thingy{}), BuildThingy)
+			listener, err := net.Listen("tcp", "localhost:0")
+			Expect(err).To(BeNil())
+			defer listener.Close()
+			server := NewServer(listener, TagSocketAll, server_type_store)
+			server.AcceptRequest("all", reflect.TypeOf(Thingy{}), func(_ interface{}, context TLBContext) {
+				context.Respond(Thingy{
+					Name: "still connected",
+				})
+			})
+			client_socket, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).To(BeNil())
+			defer client_socket.Close()
+			client := NewClient(client_socket, client_type_store, false)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_, err = client.Handshake(ctx)
+			Expect(err).To(BeNil())
+			err = client.Message(Gadget{
+				Size: 3,
+			})
+			Expect(err).To(BeNil())
+			iface, err := client.RequestContext(ctx, thingy, reflect.TypeOf(Thingy{}))
+			Expect(err).To(BeNil())
+			Expect(iface).To(Equal(&Thingy{
+				Name: "still connected",
+			}))
+			Expect(server.FailedSockets).ToNot(Receive())
+		})
+	})
+})
@@ -0,0 +1,253 @@
+package tlb
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+//
+// Errors a connection is closed with when the other end stops
+// responding.  ErrHeartbeatTimeout means too many heartbeat intervals
+// passed without receiving anything, and ErrIdleTimeout means a read or
+// write took longer than the idle timeouts allow.
+//
+var (
+	ErrHeartbeatTimeout = errors.New("heartbeat timed out")
+	ErrIdleTimeout      = errors.New("connection idle timeout")
+)
+
+//
+// A HeartbeatPing is sent every heartbeat interval, and is answered
+// with a HeartbeatPong carrying the same ID.
+//
+type HeartbeatPing struct {
+	ID uint32
+}
+
+//
+// A HeartbeatPong answers a HeartbeatPing.
+//
+type HeartbeatPong struct {
+	ID uint32
+}
+
+//
+// A Heartbeat holds the settings used to detect dead connections,
+// shared by every connection of a Server or Client.  Heartbeats are
+// off and no deadlines are set until they are configured.  Changed is
+// closed and replaced whenever the settings change.
+//
+type Heartbeat struct {
+	Interval     time.Duration
+	Misses       int
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	Changed      chan struct{}
+	Manipulation *sync.Mutex
+}
+
+//
+// Create a Heartbeat that sends no Pings and sets no deadlines.
+//
+func NewHeartbeat() *Heartbeat {
+	return &Heartbeat{
+		Changed:      make(chan struct{}),
+		Manipulation: &sync.Mutex{},
+	}
+}
+
+//
+// Configure sends a HeartbeatPing on every connection each interval,
+// and closes a connection with ErrHeartbeatTimeout once misses
+// intervals in a row pass without receiving anything on it.  Both ends
+// answer Pings automatically, but the other end must run a version of
+// TLB that understands them.  An interval of zero stops sending Pings.
+//
+func (heartbeat *Heartbeat) Configure(interval time.Duration, misses int) {
+	heartbeat.Manipulation.Lock()
+	heartbeat.Interval = interval
+	heartbeat.Misses = misses
+	heartbeat.changed()
+	heartbeat.Manipulation.Unlock()
+}
+
+//
+// SetIdleTimeouts sets deadlines on connections so that waiting longer
+// than read for the next struct, or longer than write to send one,
+// closes the connection with ErrIdleTimeout.  Zero disables either
+// deadline, and deadlines already set are cleared, so SetIdleTimeouts(0, 0)
+// leaves sockets as they were before any timeouts were set.  A new read
+// timeout also applies to reads already waiting.
+//
+func (heartbeat *Heartbeat) SetIdleTimeouts(read time.Duration, write time.Duration) {
+	heartbeat.Manipulation.Lock()
+	heartbeat.ReadTimeout = read
+	heartbeat.WriteTimeout = write
+	heartbeat.changed()
+	heartbeat.Manipulation.Unlock()
+}
+
+//
+// Wake everything waiting on heartbeat.Changed.  The caller must hold
+// heartbeat.Manipulation.
+//
+func (heartbeat *Heartbeat) changed() {
+	close(heartbeat.Changed)
+	heartbeat.Changed = make(chan struct{})
+}
+
+//
+// Set the deadline for the next read from a socket if a read timeout
+// is set, or clear the deadline an earlier read left on it.  set records
+// whether the socket has a read deadline, and is only used by the
+// goroutine reading the socket.  Sockets that never had a deadline are
+// left alone, so callers can still set their own.
+//
+func (heartbeat *Heartbeat) setReadDeadline(socket net.Conn, set *bool) {
+	heartbeat.Manipulation.Lock()
+	defer heartbeat.Manipulation.Unlock()
+	timeout := heartbeat.ReadTimeout
+	if timeout > 0 || *set {
+		socket.SetReadDeadline(deadline(timeout))
+	}
+	*set = timeout > 0
+}
+
+//
+// Set the deadline for the next write to a socket if a write timeout
+// is set, or clear the deadline an earlier write left on it.  set records
+// whether the socket has a write deadline, and is guarded by the lock
+// held while writing to the socket.
+//
+func (heartbeat *Heartbeat) setWriteDeadline(socket net.Conn, set *bool) {
+	heartbeat.Manipulation.Lock()
+	timeout := heartbeat.WriteTimeout
+	heartbeat.Manipulation.Unlock()
+	if timeout > 0 || *set {
+		socket.SetWriteDeadline(deadline(timeout))
+	}
+	*set = timeout > 0
+}
+
+//
+// Return the deadline for an operation starting now, or no deadline
+// if timeout is zero.
+//
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+//
+// Return ErrIdleTimeout if err is a socket deadline passing, or err.
+//
+func idleError(err error) error {
+	if net_err, ok := err.(net.Error); ok && net_err.Timeout() {
+		return ErrIdleTimeout
+	}
+	return err
+}
+
+//
+// Note that something was received on a connection being monitored.
+//
+func beat(beats chan struct{}) {
+	select {
+	case beats <- struct{}{}:
+	default:
+	}
+}
+
+//
+// Send a HeartbeatPing with ping at the start of every interval for as
+// long as heartbeats are configured and stopped is open, calling fail
+// with ErrHeartbeatTimeout if misses intervals in a row end without a
+// beat.
+// Pings are sent in their own goroutine so a socket that stopped
+// accepting writes cannot stall the monitor, and no Ping is sent while
+// the previous one is still being written.  When the read timeout
+// changes, the new one is applied to the read waiting on socket.
+//
+func (heartbeat *Heartbeat) monitor(socket net.Conn, beats chan struct{}, stopped <-chan struct{}, ping func(HeartbeatPing) error, fail func(error)) {
+	missed := 0
+	var id uint32
+	pinging := make(chan struct{}, 1)
+	heartbeat.Manipulation.Lock()
+	read_timeout := heartbeat.ReadTimeout
+	heartbeat.Manipulation.Unlock()
+	for {
+		heartbeat.Manipulation.Lock()
+		interval, misses, changed := heartbeat.Interval, heartbeat.Misses, heartbeat.Changed
+		if heartbeat.ReadTimeout != read_timeout {
+			read_timeout = heartbeat.ReadTimeout
+			socket.SetReadDeadline(deadline(read_timeout))
+		}
+		heartbeat.Manipulation.Unlock()
+		if interval <= 0 {
+			select {
+			case <-changed:
+				missed = 0
+				continue
+			case <-stopped:
+				return
+			}
+		}
+		select {
+		case pinging <- struct{}{}:
+			id += 1
+			go func(id uint32) {
+				ping(HeartbeatPing{ID: id})
+				<-pinging
+			}(id)
+		default:
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+			missed = 0
+			continue
+		case <-stopped:
+			timer.Stop()
+			return
+		}
+		select {
+		case <-beats:
+			missed = 0
+		default:
+			missed += 1
+		}
+		if misses > 0 && missed >= misses {
+			fail(ErrHeartbeatTimeout)
+			return
+		}
+	}
+}
+
+//
+// A SocketError is sent on server.SocketErrors when a socket fails,
+// with the reason it failed.
+//
+type SocketError struct {
+	Socket net.Conn
+	Err    error
+}
+
+//
+// Error allows a SocketError to be used as an error.
+//
+func (socket_error SocketError) Error() string {
+	return socket_error.Err.Error()
+}
+
+//
+// Unwrap returns the reason the socket failed.
+//
+func (socket_error SocketError) Unwrap() error {
+	return socket_error.Err
+}
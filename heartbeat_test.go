@@ -0,0 +1,159 @@
+package tlb_test
+
+import (
+	"context"
+	. "github.com/hkparker/TLB"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net"
+	"reflect"
+	"runtime"
+	"time"
+)
+
+var _ = Describe("Heartbeats", func() {
+
+	fixture := useTestServer()
+	dial := fixture.dial
+
+	silent := func() net.Conn {
+		socket, err := net.Dial("tcp", fixture.listener.Addr().String())
+		Expect(err).To(BeNil())
+		return socket
+	}
+
+	It("drops sockets that stop answering Pings", func() {
+		fixture.server.Heartbeat.Configure(20*time.Millisecond, 3)
+		socket := silent()
+		defer socket.Close()
+		Eventually(fixture.server.FailedSockets).Should(Receive())
+		var socket_error SocketError
+		Eventually(fixture.server.SocketErrors).Should(Receive(&socket_error))
+		Expect(socket_error.Err).To(Equal(ErrHeartbeatTimeout))
+	})
+
+	It("keeps clients that answer Pings connected", func() {
+		fixture.server.Heartbeat.Configure(20*time.Millisecond, 3)
+		fixture.server.AcceptRequest("all", reflect.TypeOf(Thingy{}), func(_ interface{}, context TLBContext) {
+			context.Respond(Thingy{Name: "pong"})
+		})
+		client := dial()
+		defer client.Close()
+		Consistently(fixture.server.FailedSockets, 200*time.Millisecond).ShouldNot(Receive())
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		iface, err := client.RequestContext(ctx, Thingy{}, reflect.TypeOf(Thingy{}))
+		Expect(err).To(BeNil())
+		Expect(iface).To(Equal(&Thingy{Name: "pong"}))
+	})
+
+	It("closes clients whose server stops answering Pings", func() {
+		silent_listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).To(BeNil())
+		defer silent_listener.Close()
+		client_socket, err := net.Dial("tcp", silent_listener.Addr().String())
+		Expect(err).To(BeNil())
+		client := NewClient(client_socket, fixture.typeStore, false)
+		client.Heartbeat.Configure(20*time.Millisecond, 3)
+		Eventually(client.Done()).Should(BeClosed())
+		Expect(client.Err()).To(Equal(ErrHeartbeatTimeout))
+		Eventually(client.Dead).Should(Receive(Equal(ErrHeartbeatTimeout)))
+	})
+
+	It("gives the other end a full interval to answer each Ping", func() {
+		client := dial()
+		defer client.Close()
+		client.Heartbeat.Configure(50*time.Millisecond, 1)
+		Consistently(client.Done(), 300*time.Millisecond).ShouldNot(BeClosed())
+		Expect(client.Err()).To(BeNil())
+	})
+
+	It("drops sockets that stay idle past the read timeout", func() {
+		fixture.server.Heartbeat.SetIdleTimeouts(100*time.Millisecond, 0)
+		socket := silent()
+		defer socket.Close()
+		var socket_error SocketError
+		Eventually(fixture.server.SocketErrors).Should(Receive(&socket_error))
+		Expect(socket_error.Err).To(Equal(ErrIdleTimeout))
+	})
+
+	It("keeps sockets sending Pings from going idle", func() {
+		fixture.server.Heartbeat.SetIdleTimeouts(100*time.Millisecond, 0)
+		client := dial()
+		defer client.Close()
+		client.Heartbeat.Configure(20*time.Millisecond, 3)
+		Consistently(fixture.server.FailedSockets, 300*time.Millisecond).ShouldNot(Receive())
+		Expect(client.Err()).To(BeNil())
+	})
+
+	It("closes clients when a write takes longer than the write timeout", func() {
+		client_socket, server_socket := net.Pipe()
+		defer server_socket.Close()
+		client := NewClient(client_socket, fixture.typeStore, false)
+		client.Heartbeat.SetIdleTimeouts(0, 50*time.Millisecond)
+		Expect(client.Message(Thingy{})).To(Equal(ErrIdleTimeout))
+		Eventually(client.Done()).Should(BeClosed())
+		Expect(client.Err()).To(Equal(ErrIdleTimeout))
+	})
+
+	It("stops timing out waiting reads once idle timeouts are turned off", func() {
+		fixture.server.Heartbeat.SetIdleTimeouts(150*time.Millisecond, 0)
+		client := dial()
+		defer client.Close()
+		Expect(client.Message(Thingy{})).To(BeNil())
+		time.Sleep(50 * time.Millisecond)
+		fixture.server.Heartbeat.SetIdleTimeouts(0, 0)
+		Consistently(fixture.server.SocketErrors, 400*time.Millisecond).ShouldNot(Receive())
+	})
+
+	It("clears write deadlines once idle timeouts are turned off", func() {
+		client_socket, server_socket := net.Pipe()
+		defer server_socket.Close()
+		client := NewClient(client_socket, fixture.typeStore, false)
+		defer client.Close()
+		client.Heartbeat.SetIdleTimeouts(0, 50*time.Millisecond)
+		go server_socket.Read(make([]byte, 1024))
+		Expect(client.Message(Thingy{})).To(BeNil())
+		client.Heartbeat.SetIdleTimeouts(0, 0)
+		time.Sleep(100 * time.Millisecond)
+		written := make(chan error, 1)
+		go func() {
+			written <- client.Message(Thingy{})
+		}()
+		Consistently(written, 100*time.Millisecond).ShouldNot(Receive())
+		go server_socket.Read(make([]byte, 1024))
+		Eventually(written).Should(Receive(BeNil()))
+	})
+
+	It("closes Peers whose other end stops reading", func() {
+		left_socket, right_socket := net.Pipe()
+		defer right_socket.Close()
+		left := NewPeer(left_socket, fixture.typeStore)
+		left.Client.Heartbeat.Configure(20*time.Millisecond, 3)
+		Eventually(left.Done()).Should(BeClosed())
+		Expect(left.Err()).To(Equal(ErrHeartbeatTimeout))
+	})
+
+	It("does not pile up Pings on a socket that stopped accepting writes", func() {
+		client_socket, server_socket := net.Pipe()
+		defer server_socket.Close()
+		client := NewClient(client_socket, fixture.typeStore, false)
+		defer client.Close()
+		before := runtime.NumGoroutine()
+		client.Heartbeat.Configure(5*time.Millisecond, 0)
+		time.Sleep(300 * time.Millisecond)
+		Expect(runtime.NumGoroutine() - before).To(BeNumerically("<", 5))
+	})
+
+	It("keeps Peers that answer Pings connected", func() {
+		left_socket, right_socket := net.Pipe()
+		left := NewPeer(left_socket, fixture.typeStore)
+		right := NewPeer(right_socket, fixture.typeStore)
+		defer left.Close()
+		defer right.Close()
+		left.Client.Heartbeat.Configure(20*time.Millisecond, 3)
+		right.Client.Heartbeat.SetIdleTimeouts(100*time.Millisecond, 0)
+		Consistently(left.Done(), 300*time.Millisecond).ShouldNot(BeClosed())
+		Expect(right.Err()).To(BeNil())
+	})
+})
@@ -0,0 +1,86 @@
+package tlb
+
+import (
+	"sync"
+)
+
+//
+// A Handler is a callback for a struct received on a connection, the
+// type of the functions given to server.Accept and server.AcceptRequest.
+//
+type Handler func(interface{}, TLBContext)
+
+//
+// An Interceptor wraps a Handler with another.  The new Handler can
+// change the struct or the TLBContext before calling the wrapped one,
+// or not call it at all, for example after responding to a request
+// with context.RespondError.
+//
+type Interceptor func(Handler) Handler
+
+//
+// A Sender writes a struct to a connection, as client.Message,
+// client.Request, context.Respond and server.Broadcast do.
+//
+type Sender func(interface{}) error
+
+//
+// An OutboundInterceptor wraps a Sender with another, which can change
+// the struct before sending it or return an error instead.
+//
+type OutboundInterceptor func(Sender) Sender
+
+//
+// The interceptors shared by every copy of a Server or Client.
+//
+type interceptors struct {
+	inbound      []Interceptor
+	outbound     []OutboundInterceptor
+	manipulation *sync.Mutex
+}
+
+func newInterceptors() *interceptors {
+	return &interceptors{
+		manipulation: &sync.Mutex{},
+	}
+}
+
+func (chain *interceptors) use(inbound []Interceptor) {
+	chain.manipulation.Lock()
+	chain.inbound = append(chain.inbound, inbound...)
+	chain.manipulation.Unlock()
+}
+
+func (chain *interceptors) useOutbound(outbound []OutboundInterceptor) {
+	chain.manipulation.Lock()
+	chain.outbound = append(chain.outbound, outbound...)
+	chain.manipulation.Unlock()
+}
+
+//
+// Wrap a Handler in every inbound interceptor, with the first one added
+// running first.
+//
+func (chain *interceptors) wrap(handler Handler) Handler {
+	chain.manipulation.Lock()
+	inbound := chain.inbound
+	chain.manipulation.Unlock()
+	for i := len(inbound) - 1; i >= 0; i-- {
+		handler = inbound[i](handler)
+	}
+	return handler
+}
+
+//
+// Wrap a Sender in every outbound interceptor, with the first one added
+// running first.
+//
+func (chain *interceptors) wrapSender(sender Sender) Sender {
+	chain.manipulation.Lock()
+	outbound := chain.outbound
+	chain.manipulation.Unlock()
+	for i := len(outbound) - 1; i >= 0; i-- {
+		sender = outbound[i](sender)
+	}
+	return sender
+}
@@ -0,0 +1,222 @@
+package tlb_test
+
+import (
+	"context"
+	"errors"
+	. "github.com/hkparker/TLB"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net"
+	"reflect"
+	"time"
+)
+
+type userKey struct{}
+
+var _ = Describe("Interceptors", func() {
+
+	fixture := useTestServer()
+	dial := fixture.dial
+
+	record := func(calls chan string, name string) Interceptor {
+		return func(next Handler) Handler {
+			return func(iface interface{}, context TLBContext) {
+				calls <- name
+				next(iface, context)
+			}
+		}
+	}
+
+	It("runs server interceptors in the order they were added", func() {
+		calls := make(chan string, 3)
+		fixture.server.Use(record(calls, "first"), record(calls, "second"))
+		fixture.server.Accept("all", reflect.TypeOf(Thingy{}), func(_ interface{}, _ TLBContext) {
+			calls <- "callback"
+		})
+		client := dial()
+		defer client.Close()
+		Expect(client.Message(newThingy())).To(BeNil())
+		Eventually(calls).Should(Receive(Equal("first")))
+		Eventually(calls).Should(Receive(Equal("second")))
+		Eventually(calls).Should(Receive(Equal("callback")))
+	})
+
+	It("lets interceptors pass values to callbacks in the context", func() {
+		fixture.server.Use(func(next Handler) Handler {
+			return func(iface interface{}, context TLBContext) {
+				context.Context = contextWithUser(context.Context, "alice")
+				next(iface, context)
+			}
+		})
+		users := make(chan interface{}, 1)
+		fixture.server.Accept("all", reflect.TypeOf(Thingy{}), func(_ interface{}, context TLBContext) {
+			users <- context.Context.Value(userKey{})
+		})
+		client := dial()
+		defer client.Close()
+		Expect(client.Message(newThingy())).To(BeNil())
+		Eventually(users).Should(Receive(Equal("alice")))
+	})
+
+	It("lets interceptors reject requests before the callback runs", func() {
+		fixture.server.Use(func(next Handler) Handler {
+			return func(iface interface{}, context TLBContext) {
+				context.RespondError(ErrorResponse{Code: 401, Message: "unauthorized"})
+			}
+		})
+		called := make(chan bool, 1)
+		fixture.server.AcceptRequest("all", reflect.TypeOf(Thingy{}), func(_ interface{}, context TLBContext) {
+			called <- true
+			context.Respond(newThingy())
+		})
+		client := dial()
+		defer client.Close()
+		_, err := client.RequestContext(fixture.ctx, newThingy(), reflect.TypeOf(Thingy{}))
+		var response ErrorResponse
+		Expect(errors.As(err, &response)).To(BeTrue())
+		Expect(response.Code).To(Equal(401))
+		Consistently(called, 50*time.Millisecond).ShouldNot(Receive())
+	})
+
+	It("runs outbound interceptors around server responses", func() {
+		fixture.server.UseOutbound(func(next Sender) Sender {
+			return func(iface interface{}) error {
+				if response, correct_type := iface.(Thingy); correct_type {
+					response.Name = "intercepted"
+					return next(response)
+				}
+				return next(iface)
+			}
+		})
+		fixture.server.AcceptRequest("all", reflect.TypeOf(Thingy{}), func(_ interface{}, context TLBContext) {
+			context.Respond(newThingy())
+		})
+		client := dial()
+		defer client.Close()
+		iface, err := client.RequestContext(fixture.ctx, newThingy(), reflect.TypeOf(Thingy{}))
+		Expect(err).To(BeNil())
+		Expect(iface).To(Equal(&Thingy{Name: "intercepted", ID: 1}))
+	})
+
+	It("runs client interceptors around responses and messages", func() {
+		fixture.server.AcceptRequest("all", reflect.TypeOf(Thingy{}), func(_ interface{}, context TLBContext) {
+			context.Respond(newThingy())
+		})
+		client := dial()
+		defer client.Close()
+		calls := make(chan string, 1)
+		client.Use(record(calls, "response"))
+		_, err := client.RequestContext(fixture.ctx, newThingy(), reflect.TypeOf(Thingy{}))
+		Expect(err).To(BeNil())
+		Eventually(calls).Should(Receive(Equal("response")))
+		blocked := errors.New("blocked")
+		client.UseOutbound(func(next Sender) Sender {
+			return func(iface interface{}) error {
+				return blocked
+			}
+		})
+		Expect(client.Message(newThingy())).To(Equal(blocked))
+	})
+
+	It("runs client interceptors around the error callbacks of failed requests", func() {
+		client := dial()
+		defer client.Close()
+		client.RequestTimeout = 50 * time.Millisecond
+		intercepted := make(chan interface{}, 1)
+		client.Use(func(next Handler) Handler {
+			return func(iface interface{}, context TLBContext) {
+				intercepted <- iface
+				next(iface, context)
+			}
+		})
+		request, err := client.Request(newThingy())
+		Expect(err).To(BeNil())
+		failures := make(chan error, 1)
+		request.OnError(func(err error) {
+			failures <- err
+		})
+		Eventually(intercepted).Should(Receive(Equal(ErrRequestTimeout)))
+		Eventually(failures).Should(Receive(Equal(ErrRequestTimeout)))
+	})
+
+	It("runs client outbound interceptors around requests", func() {
+		fixture.server.AcceptRequest("all", reflect.TypeOf(Thingy{}), func(iface interface{}, context TLBContext) {
+			context.Respond(iface)
+		})
+		client := dial()
+		defer client.Close()
+		client.UseOutbound(func(next Sender) Sender {
+			return func(iface interface{}) error {
+				if request, correct_type := iface.(Thingy); correct_type {
+					request.Name = "intercepted"
+					return next(request)
+				}
+				return next(iface)
+			}
+		})
+		iface, err := client.RequestContext(fixture.ctx, newThingy(), reflect.TypeOf(Thingy{}))
+		Expect(err).To(BeNil())
+		Expect(iface).To(Equal(&Thingy{Name: "intercepted", ID: 1}))
+	})
+
+	It("does not send requests that an outbound interceptor rejects", func() {
+		called := make(chan bool, 1)
+		fixture.server.AcceptRequest("all", reflect.TypeOf(Thingy{}), func(_ interface{}, _ TLBContext) {
+			called <- true
+		})
+		client := dial()
+		defer client.Close()
+		blocked := errors.New("blocked")
+		client.UseOutbound(func(next Sender) Sender {
+			return func(iface interface{}) error {
+				return blocked
+			}
+		})
+		_, err := client.RequestContext(fixture.ctx, newThingy(), reflect.TypeOf(Thingy{}))
+		Expect(err).To(Equal(blocked))
+		_, err = client.Request(newThingy())
+		Expect(err).To(Equal(blocked))
+		Expect(len(client.Requests)).To(Equal(0))
+		Consistently(called, 50*time.Millisecond).ShouldNot(Receive())
+	})
+
+	It("runs server outbound interceptors around Send and Broadcast", func() {
+		sockets := make(chan net.Conn, 1)
+		fixture.server.Accept("all", reflect.TypeOf(Thingy{}), func(_ interface{}, context TLBContext) {
+			sockets <- context.Socket
+		})
+		fixture.server.UseOutbound(func(next Sender) Sender {
+			return func(iface interface{}) error {
+				if event, correct_type := iface.(Thingy); correct_type {
+					event.Name = "intercepted"
+					return next(event)
+				}
+				return next(iface)
+			}
+		})
+		client := dial()
+		defer client.Close()
+		events := make(chan interface{}, 2)
+		client.On(reflect.TypeOf(Thingy{}), func(iface interface{}) {
+			events <- iface
+		})
+		Expect(client.Message(newThingy())).To(BeNil())
+		var socket net.Conn
+		Eventually(sockets).Should(Receive(&socket))
+		Expect(fixture.server.Send(socket, newThingy())).To(BeNil())
+		Eventually(events).Should(Receive(Equal(&Thingy{Name: "intercepted", ID: 1})))
+		Expect(fixture.server.Broadcast("all", newThingy())).To(BeNil())
+		Eventually(events).Should(Receive(Equal(&Thingy{Name: "intercepted", ID: 1})))
+	})
+})
+
+func newThingy() Thingy {
+	return Thingy{
+		Name: "test",
+		ID:   1,
+	}
+}
+
+func contextWithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
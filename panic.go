@@ -0,0 +1,81 @@
+package tlb
+
+import (
+	"fmt"
+	"net"
+	"runtime/debug"
+	"sync"
+)
+
+//
+// A HandlerPanic describes a panic recovered from a callback or a
+// Builder, including the stack of the goroutine that panicked and the
+// socket the struct was received on.
+//
+type HandlerPanic struct {
+	Value  interface{}
+	Stack  []byte
+	Socket net.Conn
+}
+
+//
+// Error allows a HandlerPanic to be used as an error.
+//
+func (handler_panic HandlerPanic) Error() string {
+	return fmt.Sprintf("handler panicked: %v", handler_panic.Value)
+}
+
+//
+// Describe a recovered panic, capturing the current stack.
+//
+func newHandlerPanic(value interface{}, socket net.Conn) *HandlerPanic {
+	return &HandlerPanic{
+		Value:  value,
+		Stack:  debug.Stack(),
+		Socket: socket,
+	}
+}
+
+//
+// The hook for recovered panics shared by every copy of a Server or
+// Client, and whether the socket should be dropped after one.
+//
+type panicHandler struct {
+	hook         func(HandlerPanic)
+	drop         bool
+	manipulation *sync.Mutex
+}
+
+//
+// Create a panicHandler with no hook that keeps sockets open.
+//
+func newPanicHandler() *panicHandler {
+	return &panicHandler{
+		manipulation: &sync.Mutex{},
+	}
+}
+
+//
+// Replace the hook and whether sockets are dropped after a panic.
+//
+func (handler *panicHandler) set(hook func(HandlerPanic), drop bool) {
+	handler.manipulation.Lock()
+	handler.hook = hook
+	handler.drop = drop
+	handler.manipulation.Unlock()
+}
+
+//
+// Pass a recovered panic to the hook, reporting if the socket should
+// be dropped.
+//
+func (handler *panicHandler) report(handler_panic *HandlerPanic) bool {
+	handler.manipulation.Lock()
+	hook := handler.hook
+	drop := handler.drop
+	handler.manipulation.Unlock()
+	if hook != nil {
+		hook(*handler_panic)
+	}
+	return drop
+}
@@ -0,0 +1,176 @@
+package tlb_test
+
+import (
+	"context"
+	"errors"
+	. "github.com/hkparker/TLB"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+type Gizmo struct {
+	Label string
+}
+
+func BuildPanickingGizmo(_ []byte, _ TLBContext) interface{} {
+	panic("bad gizmo")
+}
+
+var _ = Describe("Handler panics", func() {
+
+	var panics chan HandlerPanic
+
+	fixture := useTestServer(func(type_store TypeStore) {
+		type_store.AddType(reflect.TypeOf(Gizmo{}), reflect.TypeOf(&Gizmo{}), BuildPanickingGizmo)
+	})
+	dial := fixture.dial
+
+	BeforeEach(func() {
+		panics = make(chan HandlerPanic, 10)
+	})
+
+	It("recovers from a panicking Accept callback and keeps the socket", func() {
+		fixture.server.OnHandlerPanic(func(handler_panic HandlerPanic) {
+			panics <- handler_panic
+		}, false)
+		names := make(chan string, 1)
+		fixture.server.Accept("all", reflect.TypeOf(Thingy{}), func(iface interface{}, _ TLBContext) {
+			if thingy, correct_type := iface.(*Thingy); correct_type {
+				if thingy.Name == "panic" {
+					panic("bad thingy")
+				}
+				names <- thingy.Name
+			}
+		})
+		client := dial()
+		defer client.Close()
+		Expect(client.Message(Thingy{Name: "panic"})).To(BeNil())
+		var handler_panic HandlerPanic
+		Eventually(panics).Should(Receive(&handler_panic))
+		Expect(handler_panic.Value).To(Equal("bad thingy"))
+		Expect(handler_panic.Stack).ToNot(BeEmpty())
+		Expect(handler_panic.Socket).ToNot(BeNil())
+		Expect(client.Message(Thingy{Name: "fine"})).To(BeNil())
+		Eventually(names).Should(Receive(Equal("fine")))
+	})
+
+	It("drops the socket after a panic when asked to", func() {
+		fixture.server.OnHandlerPanic(func(handler_panic HandlerPanic) {
+			panics <- handler_panic
+		}, true)
+		fixture.server.Accept("all", reflect.TypeOf(Thingy{}), func(_ interface{}, _ TLBContext) {
+			panic("bad thingy")
+		})
+		client := dial()
+		defer client.Close()
+		Expect(client.Message(Thingy{Name: "panic"})).To(BeNil())
+		Eventually(panics).Should(Receive())
+		Eventually(fixture.server.FailedSockets).Should(Receive())
+		Eventually(client.Done()).Should(BeClosed())
+	})
+
+	It("recovers from a panicking Builder", func() {
+		fixture.server.OnHandlerPanic(func(handler_panic HandlerPanic) {
+			panics <- handler_panic
+		}, false)
+		names := make(chan string, 1)
+		fixture.server.Accept("all", reflect.TypeOf(Thingy{}), func(iface interface{}, _ TLBContext) {
+			if thingy, correct_type := iface.(*Thingy); correct_type {
+				names <- thingy.Name
+			}
+		})
+		client := dial()
+		defer client.Close()
+		Expect(client.Message(Gizmo{Label: "panic"})).To(BeNil())
+		var handler_panic HandlerPanic
+		Eventually(panics).Should(Receive(&handler_panic))
+		Expect(handler_panic.Value).To(Equal("bad gizmo"))
+		Expect(client.Message(Thingy{Name: "fine"})).To(BeNil())
+		Eventually(names).Should(Receive(Equal("fine")))
+	})
+
+	It("runs callbacks for the remaining tags after a Builder panics", func() {
+		builds := int32(0)
+		tagged_store := NewTypeStore()
+		tagged_store.AddType(reflect.TypeOf(Gizmo{}), reflect.TypeOf(&Gizmo{}), func(_ []byte, _ TLBContext) interface{} {
+			if atomic.AddInt32(&builds, 1) == 1 {
+				panic("bad gizmo")
+			}
+			return &Gizmo{Label: "built"}
+		})
+		tagged_listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).To(BeNil())
+		defer tagged_listener.Close()
+		tagged_server := NewServer(tagged_listener, func(socket net.Conn, server *Server) {
+			server.TagSocket(socket, "first")
+			server.TagSocket(socket, "second")
+		}, tagged_store)
+		tagged_server.OnHandlerPanic(func(handler_panic HandlerPanic) {
+			panics <- handler_panic
+		}, false)
+		labels := make(chan string, 2)
+		for _, tag := range []string{"first", "second"} {
+			tagged_server.AcceptRequest(tag, reflect.TypeOf(Gizmo{}), func(iface interface{}, _ TLBContext) {
+				if gizmo, correct_type := iface.(*Gizmo); correct_type {
+					labels <- gizmo.Label
+				}
+			})
+		}
+		client_socket, err := net.Dial("tcp", tagged_listener.Addr().String())
+		Expect(err).To(BeNil())
+		client := NewClient(client_socket, tagged_store, false)
+		defer client.Close()
+		_, err = client.Request(Gizmo{})
+		Expect(err).To(BeNil())
+		Eventually(panics).Should(Receive())
+		Eventually(labels).Should(Receive(Equal("built")))
+		Consistently(labels, 100*time.Millisecond).ShouldNot(Receive())
+	})
+
+	It("recovers from a panicking response callback on the client", func() {
+		fixture.server.AcceptRequest("all", reflect.TypeOf(Thingy{}), func(iface interface{}, context TLBContext) {
+			context.Respond(Thingy{Name: "response"})
+		})
+		client := dial()
+		defer client.Close()
+		client.OnHandlerPanic(func(handler_panic HandlerPanic) {
+			panics <- handler_panic
+		}, true)
+		request, err := client.Request(Thingy{Name: "request"})
+		Expect(err).To(BeNil())
+		request.OnResponse(reflect.TypeOf(Thingy{}), func(_ interface{}) {
+			panic("bad response")
+		})
+		Eventually(panics).Should(Receive())
+		Eventually(client.Done()).Should(BeClosed())
+		var handler_panic *HandlerPanic
+		Expect(errors.As(client.Err(), &handler_panic)).To(BeTrue())
+		Expect(handler_panic.Value).To(Equal("bad response"))
+	})
+
+	It("keeps RequestContext working after a recovered panic", func() {
+		fixture.server.OnHandlerPanic(func(handler_panic HandlerPanic) {
+			panics <- handler_panic
+		}, false)
+		fixture.server.AcceptRequest("all", reflect.TypeOf(Thingy{}), func(iface interface{}, context TLBContext) {
+			if thingy, correct_type := iface.(*Thingy); correct_type && thingy.Name == "panic" {
+				panic("bad request")
+			}
+			context.Respond(Thingy{Name: "response"})
+		})
+		client := dial()
+		defer client.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := client.Request(Thingy{Name: "panic"})
+		Expect(err).To(BeNil())
+		Eventually(panics).Should(Receive())
+		iface, err := client.RequestContext(ctx, Thingy{Name: "fine"}, reflect.TypeOf(Thingy{}))
+		Expect(err).To(BeNil())
+		Expect(iface).To(Equal(&Thingy{Name: "response"}))
+	})
+})
@@ -0,0 +1,278 @@
+package tlb
+
+import (
+	"context"
+	"net"
+	"reflect"
+)
+
+//
+// PeerTag is the tag a Peer's socket has on the Peer's Server, which
+// callbacks registered with peer.Accept and peer.AcceptRequest are
+// stored under.
+//
+const PeerTag = "peer"
+
+//
+// A Reply carries a response to a request made by a Peer.  Peers send
+// requests in Capsules and responses in Replies so the other end can
+// tell a request it should serve from a response to its own request.
+//
+type Reply struct {
+	RequestID uint32
+	Type      uint16
+	Data      string
+}
+
+//
+// Widen returns the WideCapsule carrying the same response as this
+// Reply.
+//
+func (reply *Reply) Widen() *WideCapsule {
+	return &WideCapsule{
+		RequestID: reply.RequestID,
+		Type:      reply.Type,
+		Data:      reply.Data,
+	}
+}
+
+//
+// A Peer wraps one net.Conn that both ends can make requests on and
+// serve requests from, using a Server for the callbacks it serves and
+// a Client for the requests it makes.  Both ends of the socket must be
+// Peers for requests to be served in both directions.  The Server shares
+// the Client's Heartbeat, which configures heartbeats for the socket.
+//
+type Peer struct {
+	Socket net.Conn
+	Server *Server
+	Client *Client
+}
+
+//
+// Create a new Peer on a socket with a TypeStore containing all types
+// that will be seen on the socket, and start reading from the socket.
+//
+func NewPeer(socket net.Conn, type_store TypeStore) Peer {
+	server := newServer(nil, nil, type_store)
+	client := NewClient(socket, type_store, true)
+	server.Heartbeat = client.Heartbeat
+	connection := newConnection(socket, client.Writing, client.Heartbeat)
+	connection.reading = true
+	connection.writeDeadline = client.writeDeadline
+	server.Connections[socket] = connection
+	server.TagSocket(socket, PeerTag)
+	peer := Peer{
+		Socket: socket,
+		Server: &server,
+		Client: &client,
+	}
+	go peer.process()
+	return peer
+}
+
+//
+// Peers run process in a goroutine to read structs from the socket,
+// running the Server's callbacks for requests and events and the
+// Client's callbacks for responses and events.
+//
+func (peer Peer) process() {
+	server := peer.Server
+	client := peer.Client
+	defer server.removeConnection(peer.Socket)
+	defer server.Dispatcher.Stop()
+	defer server.Delete(peer.Socket)
+	context := TLBContext{
+		Server: server,
+		Socket: peer.Socket,
+		Responder: Responder{
+			Reply: true,
+		},
+		Context: context.Background(),
+	}
+	tags := []string{PeerTag}
+	connection := server.Connection(peer.Socket)
+	beats := client.monitor()
+	read_deadline := false
+	for {
+		client.Heartbeat.setReadDeadline(peer.Socket, &read_deadline)
+		obj, err := server.TypeStore.NextStruct(peer.Socket, context)
+		if handler_panic, ok := err.(*HandlerPanic); ok {
+			if server.panics.report(handler_panic) {
+				client.shutdown(handler_panic)
+				return
+			}
+			continue
+		}
+		if _, ok := err.(*UnknownType); ok {
+			beat(beats)
+			continue
+		}
+		if err != nil {
+			client.shutdown(connection.reason(err))
+			return
+		}
+		beat(beats)
+		switch received := obj.(type) {
+		case nil:
+			continue
+		case *Hello:
+			if received.Reply {
+				if handshake, err := server.TypeStore.negotiate(received); err == nil {
+					context.Handshake = handshake
+				}
+				select {
+				case client.Hellos <- received:
+				default:
+				}
+				continue
+			}
+			handshake, err := server.handshake(connection, received)
+			if err != nil {
+				client.shutdown(err)
+				return
+			}
+			context.Handshake = handshake
+		case *GoAway:
+			select {
+			case client.GoAways <- received:
+			default:
+			}
+		case *Cancel:
+			connection.cancelRequest(received.RequestID)
+		case *HeartbeatPing:
+			client.message(HeartbeatPong{ID: received.ID})
+		case *HeartbeatPong:
+			continue
+		case *Capsule, *WideCapsule:
+			server.dispatch(func() {
+				server.runRequestCallbacks(obj, tags, context)
+			})
+		case *Reply:
+			client.handleResponse(received.Widen(), context)
+		case *StreamFrame:
+			if received.Opener {
+				server.handleStreamFrame(received, tags, context)
+			} else {
+				client.handleStreamFrame(received, context)
+			}
+		default:
+			server.dispatch(func() {
+				server.runEventCallbacks(obj, tags, context)
+			})
+			client.handleEvent(obj, context)
+		}
+	}
+}
+
+//
+// Create a new callback to be ran when the other Peer sends a specific
+// type of struct.  An error is returned if the type is not in the
+// Peer's TypeStore or the function is nil.
+//
+func (peer *Peer) Accept(struct_type reflect.Type, function func(interface{}, TLBContext)) error {
+	return peer.Server.Accept(PeerTag, struct_type, function)
+}
+
+//
+// Create a new callback to be ran when the other Peer makes a request
+// with a specific type of struct, which can respond with
+// context.Respond.  An error is returned if the type is not in the
+// Peer's TypeStore or the function is nil.
+//
+func (peer *Peer) AcceptRequest(struct_type reflect.Type, function func(interface{}, TLBContext)) error {
+	return peer.Server.AcceptRequest(PeerTag, struct_type, function)
+}
+
+//
+// Message sends a struct to the other Peer, as client.Message does.
+//
+func (peer *Peer) Message(instance interface{}) error {
+	return peer.Client.Message(instance)
+}
+
+//
+// Request sends a struct to the other Peer inside a capsule, as
+// client.Request does.
+//
+func (peer *Peer) Request(instance interface{}) (Request, error) {
+	return peer.Client.Request(instance)
+}
+
+//
+// RequestContext makes a request to the other Peer and waits for the
+// response, as client.RequestContext does.
+//
+func (peer *Peer) RequestContext(ctx context.Context, instance interface{}, response_type reflect.Type) (interface{}, error) {
+	return peer.Client.RequestContext(ctx, instance, response_type)
+}
+
+//
+// RequestStream makes a request to the other Peer and reads every
+// response it streams back, as client.RequestStream does.
+//
+func (peer *Peer) RequestStream(ctx context.Context, instance interface{}, response_type reflect.Type) (*ResponseStream, error) {
+	return peer.Client.RequestStream(ctx, instance, response_type)
+}
+
+//
+// Create a new callback to be ran when the other Peer opens a Stream
+// with a specific type of struct, as server.AcceptStream does.
+//
+func (peer *Peer) AcceptStream(struct_type reflect.Type, function func(interface{}, *Stream, TLBContext)) error {
+	return peer.Server.AcceptStream(PeerTag, struct_type, function)
+}
+
+//
+// OpenStream opens a Stream to the other Peer, as client.OpenStream
+// does.
+//
+func (peer *Peer) OpenStream(ctx context.Context, instance interface{}) (*Stream, error) {
+	return peer.Client.OpenStream(ctx, instance)
+}
+
+//
+// Handshake exchanges Hellos with the other Peer, as client.Handshake
+// does.
+//
+func (peer *Peer) Handshake(ctx context.Context) (*Handshake, error) {
+	return peer.Client.Handshake(ctx)
+}
+
+//
+// OnHandlerPanic sets the hook run when any callback or Builder on the
+// Peer panics, closing the Peer after a panic if drop is set.
+//
+func (peer *Peer) OnHandlerPanic(hook func(HandlerPanic), drop bool) {
+	peer.Client.OnHandlerPanic(hook, drop)
+	peer.Server.OnHandlerPanic(func(handler_panic HandlerPanic) {
+		if hook != nil {
+			hook(handler_panic)
+		}
+		if drop {
+			peer.Client.shutdown(&handler_panic)
+		}
+	}, false)
+}
+
+//
+// Close closes the Peer's socket and fails its outstanding requests.
+//
+func (peer *Peer) Close() error {
+	return peer.Client.Close()
+}
+
+//
+// Done returns a channel that is closed once the Peer has been closed
+// or its socket has failed.
+//
+func (peer *Peer) Done() <-chan struct{} {
+	return peer.Client.Done()
+}
+
+//
+// Err returns why the Peer is done, or nil if it is not.
+//
+func (peer *Peer) Err() error {
+	return peer.Client.Err()
+}
@@ -0,0 +1,155 @@
+package tlb_test
+
+import (
+	"context"
+	"errors"
+	. "github.com/hkparker/TLB"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// An overlapConn records whether a Write started while another was
+// still running, yielding in each Write so unserialized writers from
+// different goroutines overlap.
+//
+type overlapConn struct {
+	net.Conn
+	writing    int32
+	overlapped int32
+}
+
+func (conn *overlapConn) Write(data []byte) (int, error) {
+	if atomic.AddInt32(&conn.writing, 1) != 1 {
+		atomic.StoreInt32(&conn.overlapped, 1)
+	}
+	runtime.Gosched()
+	n, err := conn.Conn.Write(data)
+	atomic.AddInt32(&conn.writing, -1)
+	return n, err
+}
+
+var _ = Describe("Peer", func() {
+
+	var (
+		type_store TypeStore
+		left       Peer
+		right      Peer
+		ctx        context.Context
+		cancel     context.CancelFunc
+	)
+
+	BeforeEach(func() {
+		type_store = NewTypeStore()
+		type_store.AddType(reflect.TypeOf(Thingy{}), reflect.TypeOf(&Thingy{}), BuildThingy)
+		type_store.AddType(reflect.TypeOf(Gadget{}), reflect.TypeOf(&Gadget{}), BuildGadget)
+		left_socket, right_socket := net.Pipe()
+		left = NewPeer(left_socket, type_store)
+		right = NewPeer(right_socket, type_store)
+		ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	})
+
+	AfterEach(func() {
+		cancel()
+		left.Close()
+		right.Close()
+	})
+
+	double := func(iface interface{}, context TLBContext) {
+		if thingy, correct_type := iface.(*Thingy); correct_type {
+			context.Respond(Gadget{Size: thingy.ID * 2})
+		}
+	}
+
+	It("serves requests in both directions on one socket", func() {
+		Expect(left.AcceptRequest(reflect.TypeOf(Thingy{}), double)).To(BeNil())
+		Expect(right.AcceptRequest(reflect.TypeOf(Thingy{}), double)).To(BeNil())
+		iface, err := left.RequestContext(ctx, Thingy{ID: 2}, reflect.TypeOf(Gadget{}))
+		Expect(err).To(BeNil())
+		Expect(iface).To(Equal(&Gadget{Size: 4}))
+		iface, err = right.RequestContext(ctx, Thingy{ID: 3}, reflect.TypeOf(Gadget{}))
+		Expect(err).To(BeNil())
+		Expect(iface).To(Equal(&Gadget{Size: 6}))
+	})
+
+	It("runs Accept callbacks for messages from the other peer", func() {
+		names := make(chan string, 1)
+		Expect(right.Accept(reflect.TypeOf(Thingy{}), func(iface interface{}, _ TLBContext) {
+			if thingy, correct_type := iface.(*Thingy); correct_type {
+				names <- thingy.Name
+			}
+		})).To(BeNil())
+		Expect(left.Message(Thingy{Name: "hello"})).To(BeNil())
+		Eventually(names).Should(Receive(Equal("hello")))
+	})
+
+	It("can shake hands with the other peer", func() {
+		handshake, err := left.Handshake(ctx)
+		Expect(err).To(BeNil())
+		Expect(handshake.Fingerprint).To(Equal(type_store.Fingerprint()))
+		Expect(left.AcceptRequest(reflect.TypeOf(Thingy{}), double)).To(BeNil())
+		iface, err := right.RequestContext(ctx, Thingy{ID: 5}, reflect.TypeOf(Gadget{}))
+		Expect(err).To(BeNil())
+		Expect(iface).To(Equal(&Gadget{Size: 10}))
+	})
+
+	It("is done when the other peer closes", func() {
+		Expect(left.Close()).To(BeNil())
+		Eventually(right.Done()).Should(BeClosed())
+		Expect(right.Err()).ToNot(BeNil())
+	})
+
+	It("serves requests from a Client", func() {
+		client_socket, peer_socket := net.Pipe()
+		peer := NewPeer(peer_socket, type_store)
+		defer peer.Close()
+		Expect(peer.AcceptRequest(reflect.TypeOf(Thingy{}), double)).To(BeNil())
+		client := NewClient(client_socket, type_store, false)
+		defer client.Close()
+		iface, err := client.RequestContext(ctx, Thingy{ID: 4}, reflect.TypeOf(Gadget{}))
+		Expect(err).To(BeNil())
+		Expect(iface).To(Equal(&Gadget{Size: 8}))
+	})
+
+	It("keeps concurrent requests and responses on one socket from interleaving", func() {
+		near_socket, far_socket := net.Pipe()
+		near_conn := &overlapConn{Conn: near_socket}
+		far_conn := &overlapConn{Conn: far_socket}
+		near := NewPeer(near_conn, type_store)
+		defer near.Close()
+		far := NewPeer(far_conn, type_store)
+		defer far.Close()
+		Expect(near.AcceptRequest(reflect.TypeOf(Thingy{}), double)).To(BeNil())
+		Expect(far.AcceptRequest(reflect.TypeOf(Thingy{}), double)).To(BeNil())
+		errs := make(chan error, 40)
+		var requests sync.WaitGroup
+		for i := 0; i < 40; i++ {
+			requests.Add(1)
+			go func(id int) {
+				defer requests.Done()
+				peer := near
+				if id%2 == 1 {
+					peer = far
+				}
+				iface, err := peer.RequestContext(ctx, Thingy{ID: id}, reflect.TypeOf(Gadget{}))
+				if err == nil && iface.(*Gadget).Size != id*2 {
+					err = errors.New("response for the wrong request")
+				}
+				errs <- err
+			}(i)
+		}
+		requests.Wait()
+		close(errs)
+		for err := range errs {
+			Expect(err).To(BeNil())
+		}
+		Expect(atomic.LoadInt32(&near_conn.overlapped)).To(Equal(int32(0)))
+		Expect(atomic.LoadInt32(&far_conn.overlapped)).To(Equal(int32(0)))
+	})
+})
@@ -0,0 +1,306 @@
+package tlb
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+)
+
+//
+// Defaults for the backoff between reconnection attempts, how long a
+// connection must stay up before the backoff starts over, and how long
+// a new connection has to shake hands.
+//
+var (
+	DefaultMinBackoff       = 100 * time.Millisecond
+	DefaultMaxBackoff       = 30 * time.Second
+	DefaultMinUptime        = 10 * time.Second
+	DefaultHandshakeTimeout = 10 * time.Second
+)
+
+//
+// Errors returned by a ReconnectingClient.
+//
+var (
+	ErrNotConnected = errors.New("not connected")
+	ErrClientClosed = errors.New("client closed")
+)
+
+//
+// The states a ReconnectingClient moves between.
+//
+type ConnectionState int
+
+const (
+	Disconnected ConnectionState = iota
+	Connecting
+	Connected
+	Closed
+)
+
+func (state ConnectionState) String() string {
+	switch state {
+	case Disconnected:
+		return "disconnected"
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case Closed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+//
+// A ReconnectingClient keeps a Client connected by calling Dial again,
+// with exponential backoff and jitter, whenever the Client's socket
+// fails.  Every redial waits out the backoff, which only starts over
+// once a connection has stayed up for MinUptime, so a server that
+// accepts sockets and drops them is not dialed in a loop.  Fields
+// should be set before calling Start.  If Handshake is set each new
+// Client shakes hands with the server within HandshakeTimeout, and
+// OnConnect is run with each new Client so subscriptions can be sent
+// again.  If OnConnect returns an error the connection is dropped and
+// retried.  OnStateChange is run every time the connection changes
+// state.
+//
+type ReconnectingClient struct {
+	Dial             func() (net.Conn, error)
+	TypeStore        TypeStore
+	MinBackoff       time.Duration
+	MaxBackoff       time.Duration
+	MinUptime        time.Duration
+	Handshake        bool
+	HandshakeTimeout time.Duration
+	OnConnect        func(*Client) error
+	OnStateChange    func(ConnectionState)
+	State            ConnectionState
+	Client           *Client
+	Changed          chan struct{}
+	Closing          chan struct{}
+	Manipulation     *sync.Mutex
+}
+
+//
+// Create a new ReconnectingClient that uses dial to open sockets to
+// the server.  Nothing is dialed until Start is called.
+//
+func NewReconnectingClient(dial func() (net.Conn, error), type_store TypeStore) *ReconnectingClient {
+	return &ReconnectingClient{
+		Dial:             dial,
+		TypeStore:        type_store,
+		MinBackoff:       DefaultMinBackoff,
+		MaxBackoff:       DefaultMaxBackoff,
+		MinUptime:        DefaultMinUptime,
+		HandshakeTimeout: DefaultHandshakeTimeout,
+		State:            Disconnected,
+		Changed:          make(chan struct{}),
+		Closing:          make(chan struct{}),
+		Manipulation:     &sync.Mutex{},
+	}
+}
+
+//
+// Start connecting to the server in a goroutine that reconnects until
+// Close is called.
+//
+func (reconnecting *ReconnectingClient) Start() {
+	go reconnecting.process()
+}
+
+//
+// ReconnectingClients run process in a goroutine to dial the server,
+// wait for the connection to fail, and dial again after the backoff.
+//
+func (reconnecting *ReconnectingClient) process() {
+	attempt := 0
+	for {
+		reconnecting.setState(Connecting, nil)
+		client, err := reconnecting.connect()
+		if err == nil {
+			connected := time.Now()
+			reconnecting.setState(Connected, client)
+			select {
+			case <-client.Done():
+			case <-reconnecting.Closing:
+				client.Close()
+				reconnecting.setState(Closed, nil)
+				return
+			}
+			if time.Since(connected) >= reconnecting.MinUptime {
+				attempt = 0
+			}
+		}
+		reconnecting.setState(Disconnected, nil)
+		select {
+		case <-time.After(reconnecting.backoff(attempt)):
+			attempt++
+		case <-reconnecting.Closing:
+			reconnecting.setState(Closed, nil)
+			return
+		}
+	}
+}
+
+//
+// Dial the server and prepare a new Client on the socket.
+//
+func (reconnecting *ReconnectingClient) connect() (*Client, error) {
+	socket, err := reconnecting.Dial()
+	if err != nil {
+		return nil, err
+	}
+	client := NewClient(socket, reconnecting.TypeStore, false)
+	if reconnecting.Handshake {
+		ctx, cancel := context.WithTimeout(context.Background(), reconnecting.HandshakeTimeout)
+		_, err = client.Handshake(ctx)
+		cancel()
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	if reconnecting.OnConnect != nil {
+		err = reconnecting.OnConnect(&client)
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return &client, nil
+}
+
+//
+// Return how long to wait before the next attempt to connect, doubling
+// MinBackoff for each failed attempt up to MaxBackoff and picking a
+// random duration between half that and all of it.
+//
+func (reconnecting *ReconnectingClient) backoff(attempt int) time.Duration {
+	delay := reconnecting.MinBackoff
+	for i := 0; i < attempt && delay < reconnecting.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > reconnecting.MaxBackoff {
+		delay = reconnecting.MaxBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+//
+// Move to a new state, swapping in the current Client and waking
+// anything waiting for a connection.
+//
+func (reconnecting *ReconnectingClient) setState(state ConnectionState, client *Client) {
+	reconnecting.Manipulation.Lock()
+	changed := reconnecting.State != state
+	reconnecting.State = state
+	reconnecting.Client = client
+	close(reconnecting.Changed)
+	reconnecting.Changed = make(chan struct{})
+	reconnecting.Manipulation.Unlock()
+	if changed && reconnecting.OnStateChange != nil {
+		reconnecting.OnStateChange(state)
+	}
+}
+
+//
+// Return the current Client if connected, otherwise ErrNotConnected
+// or ErrClientClosed.
+//
+func (reconnecting *ReconnectingClient) current() (*Client, <-chan struct{}, error) {
+	reconnecting.Manipulation.Lock()
+	defer reconnecting.Manipulation.Unlock()
+	if reconnecting.State == Closed {
+		return nil, nil, ErrClientClosed
+	}
+	if reconnecting.State == Connected && reconnecting.Client.Err() == nil {
+		return reconnecting.Client, reconnecting.Changed, nil
+	}
+	return nil, reconnecting.Changed, ErrNotConnected
+}
+
+//
+// Wait until there is a connected Client or the context is done.
+//
+func (reconnecting *ReconnectingClient) connected(ctx context.Context) (*Client, error) {
+	for {
+		client, changed, err := reconnecting.current()
+		if err != ErrNotConnected {
+			return client, err
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+//
+// Message sends a struct on the current connection, returning
+// ErrNotConnected if there is none.
+//
+func (reconnecting *ReconnectingClient) Message(instance interface{}) error {
+	client, _, err := reconnecting.current()
+	if err != nil {
+		return err
+	}
+	return client.Message(instance)
+}
+
+//
+// RequestContext waits for a connection and then makes a request as
+// client.RequestContext does.  The request fails if the connection
+// is lost before a response arrives.
+//
+func (reconnecting *ReconnectingClient) RequestContext(ctx context.Context, instance interface{}, response_type reflect.Type) (interface{}, error) {
+	client, err := reconnecting.connected(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client.RequestContext(ctx, instance, response_type)
+}
+
+//
+// IdempotentRequest is RequestContext for requests that are safe to
+// send more than once.  If the connection is lost before a response
+// arrives the request is sent again once reconnected, until the
+// context is done.
+//
+func (reconnecting *ReconnectingClient) IdempotentRequest(ctx context.Context, instance interface{}, response_type reflect.Type) (interface{}, error) {
+	for {
+		client, err := reconnecting.connected(ctx)
+		if err != nil {
+			return nil, err
+		}
+		response, err := client.RequestContext(ctx, instance, response_type)
+		if err != nil && client.Err() != nil && ctx.Err() == nil {
+			continue
+		}
+		return response, err
+	}
+}
+
+//
+// Close stops reconnecting and closes the current connection.
+//
+func (reconnecting *ReconnectingClient) Close() error {
+	reconnecting.Manipulation.Lock()
+	defer reconnecting.Manipulation.Unlock()
+	select {
+	case <-reconnecting.Closing:
+		return ErrClientClosed
+	default:
+		close(reconnecting.Closing)
+		return nil
+	}
+}
@@ -0,0 +1,142 @@
+package tlb_test
+
+import (
+	"context"
+	. "github.com/hkparker/TLB"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+var _ = Describe("ReconnectingClient", func() {
+
+	var (
+		populated_type_store TypeStore
+		thingy               Thingy
+	)
+
+	BeforeEach(func() {
+		populated_type_store = NewTypeStore()
+		populated_type_store.AddType(reflect.TypeOf(Thingy{}), reflect.TypeOf(&Thingy{}), BuildThingy)
+		thingy = Thingy{
+			Name: "test",
+			ID:   1,
+		}
+	})
+
+	It("reconnects after the socket is closed", func() {
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).To(BeNil())
+		defer listener.Close()
+		sockets := make(chan net.Conn, 2)
+		server := NewServer(listener, func(socket net.Conn, server *Server) {
+			server.TagSocket(socket, "all")
+			sockets <- socket
+		}, populated_type_store)
+		server.AcceptRequest("all", reflect.TypeOf(Thingy{}), func(_ interface{}, context TLBContext) {
+			context.Respond(thingy)
+		})
+		states := make(chan ConnectionState, 10)
+		client := NewReconnectingClient(func() (net.Conn, error) {
+			return net.Dial("tcp", listener.Addr().String())
+		}, populated_type_store)
+		client.MinBackoff = 10 * time.Millisecond
+		client.OnStateChange = func(state ConnectionState) {
+			states <- state
+		}
+		client.Start()
+		defer client.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = client.RequestContext(ctx, thingy, reflect.TypeOf(Thingy{}))
+		Expect(err).To(BeNil())
+		(<-sockets).Close()
+		_, err = client.IdempotentRequest(ctx, thingy, reflect.TypeOf(Thingy{}))
+		Expect(err).To(BeNil())
+		Expect(<-states).To(Equal(Connecting))
+		Expect(<-states).To(Equal(Connected))
+		Expect(<-states).To(Equal(Disconnected))
+		Expect(<-states).To(Equal(Connecting))
+		Expect(<-states).To(Equal(Connected))
+	})
+
+	It("backs off before redialing a server that drops every connection", func() {
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).To(BeNil())
+		defer listener.Close()
+		go func() {
+			for {
+				socket, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				socket.Close()
+			}
+		}()
+		var dials int32
+		client := NewReconnectingClient(func() (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return net.Dial("tcp", listener.Addr().String())
+		}, populated_type_store)
+		client.MinBackoff = 10 * time.Millisecond
+		client.MaxBackoff = 40 * time.Millisecond
+		client.Start()
+		defer client.Close()
+		time.Sleep(500 * time.Millisecond)
+		Expect(atomic.LoadInt32(&dials)).To(BeNumerically("<", 60))
+	})
+
+	It("replays idempotent requests when the connection is lost", func() {
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).To(BeNil())
+		defer listener.Close()
+		server := NewServer(listener, TagSocketAll, populated_type_store)
+		var received int32
+		server.AcceptRequest("all", reflect.TypeOf(Thingy{}), func(_ interface{}, context TLBContext) {
+			if atomic.AddInt32(&received, 1) == 1 {
+				context.Socket.Close()
+				return
+			}
+			context.Respond(thingy)
+		})
+		client := NewReconnectingClient(func() (net.Conn, error) {
+			return net.Dial("tcp", listener.Addr().String())
+		}, populated_type_store)
+		client.MinBackoff = 10 * time.Millisecond
+		client.Start()
+		defer client.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		iface, err := client.IdempotentRequest(ctx, thingy, reflect.TypeOf(Thingy{}))
+		Expect(err).To(BeNil())
+		Expect(iface).To(Equal(&thingy))
+		Expect(atomic.LoadInt32(&received)).To(Equal(int32(2)))
+	})
+
+	It("reports ErrNotConnected for messages while disconnected", func() {
+		client := NewReconnectingClient(func() (net.Conn, error) {
+			return nil, ErrNotConnected
+		}, populated_type_store)
+		client.MinBackoff = 10 * time.Millisecond
+		client.Start()
+		Expect(client.Message(thingy)).To(Equal(ErrNotConnected))
+		Expect(client.Close()).To(BeNil())
+		Expect(client.Close()).To(Equal(ErrClientClosed))
+	})
+
+	It("stops waiting for a connection when the context is done", func() {
+		client := NewReconnectingClient(func() (net.Conn, error) {
+			return nil, ErrNotConnected
+		}, populated_type_store)
+		client.MinBackoff = 10 * time.Millisecond
+		client.Start()
+		defer client.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := client.RequestContext(ctx, thingy, reflect.TypeOf(Thingy{}))
+		Expect(err).To(Equal(context.DeadlineExceeded))
+	})
+})
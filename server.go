@@ -1,6 +1,8 @@
 package tlb
 
 import (
+	"context"
+	"errors"
 	"net"
 	"reflect"
 	"sync"
@@ -19,19 +21,50 @@ type Server struct {
 	Sockets         map[string][]net.Conn
 	Events          map[string]map[uint16][]func(interface{}, TLBContext)
 	Requests        map[string]map[uint16][]func(interface{}, TLBContext)
+	Streams         map[string]map[uint16]func(interface{}, *Stream, TLBContext)
 	FailedServer    chan error
 	FailedSockets   chan net.Conn
+	SocketErrors    chan SocketError
 	TagManipulation *sync.Mutex
 	InsertRequests  *sync.Mutex
 	InsertEvents    *sync.Mutex
+	InsertStreams   *sync.Mutex
+	Ordered         map[string]*Ordering
+	InsertOrdered   *sync.Mutex
+	Connections     map[net.Conn]*Connection
+	Running         *sync.WaitGroup
+	Dispatcher      *Dispatcher
+	Heartbeat       *Heartbeat
+	Dispatching     *sync.RWMutex
+	Closing         chan struct{}
+	Strict          bool
+	SendGoAway      bool
+	BroadcastQueue  int
+	panics          *panicHandler
+	interceptors    *interceptors
 }
 
 //
 // Create a new server from a net.Listener, a TypeStore, and a tagging
-// function that will assign tags to all accepted sockets.
+// function that will assign tags to all accepted sockets.  Setting
+// server.Strict makes misuse of Accept and AcceptRequest panic instead
+// of returning an error, so it is caught as soon as the server starts.
+// Setting server.SendGoAway makes server.Shutdown tell every tagged
+// socket that the server is going away.  Callbacks each run in their
+// own goroutine until server.Dispatcher is configured to limit them.
+// Dead sockets are only detected once server.Heartbeat is configured.
 //
 func NewServer(listener net.Listener, tag func(net.Conn, *Server), type_store TypeStore) Server {
-	server := Server{
+	server := newServer(listener, tag, type_store)
+	go server.process()
+	return server
+}
+
+//
+// Create a new server without starting to accept connections.
+//
+func newServer(listener net.Listener, tag func(net.Conn, *Server), type_store TypeStore) Server {
+	return Server{
 		Listener:        listener,
 		TypeStore:       type_store,
 		Tag:             tag,
@@ -39,46 +72,155 @@ func NewServer(listener net.Listener, tag func(net.Conn, *Server), type_store Ty
 		Sockets:         make(map[string][]net.Conn),
 		Events:          make(map[string]map[uint16][]func(interface{}, TLBContext)),
 		Requests:        make(map[string]map[uint16][]func(interface{}, TLBContext)),
+		Streams:         make(map[string]map[uint16]func(interface{}, *Stream, TLBContext)),
 		FailedServer:    make(chan error, 1),
 		FailedSockets:   make(chan net.Conn, 200),
+		SocketErrors:    make(chan SocketError, 200),
 		TagManipulation: &sync.Mutex{},
 		InsertRequests:  &sync.Mutex{},
 		InsertEvents:    &sync.Mutex{},
+		InsertStreams:   &sync.Mutex{},
+		Ordered:         make(map[string]*Ordering),
+		InsertOrdered:   &sync.Mutex{},
+		Connections:     make(map[net.Conn]*Connection),
+		Running:         &sync.WaitGroup{},
+		Dispatcher:      NewDispatcher(),
+		Heartbeat:       NewHeartbeat(),
+		Dispatching:     &sync.RWMutex{},
+		Closing:         make(chan struct{}),
+		BroadcastQueue:  DefaultBroadcastQueue,
+		panics:          newPanicHandler(),
+		interceptors:    newInterceptors(),
 	}
-	go server.process()
-	return server
 }
 
 //
 // Create a new callback to be ran when a socket with a certain tag receives
 // a specific type of struct.  The server will have no ability to respond
-// statefully to this event.
+// statefully to this event.  An error is returned if the type is not in the
+// server's TypeStore or the function is nil.
 //
-func (server *Server) Accept(socket_tag string, struct_type reflect.Type, function func(interface{}, TLBContext)) {
+func (server *Server) Accept(socket_tag string, struct_type reflect.Type, function func(interface{}, TLBContext)) error {
+	type_code, err := server.callbackCode(struct_type, function)
+	if err != nil {
+		return server.misuse(err)
+	}
+	server.InsertEvents.Lock()
 	if server.Events[socket_tag] == nil {
 		server.Events[socket_tag] = make(map[uint16][]func(interface{}, TLBContext))
 	}
-	if type_code, present := server.TypeStore.LookupCode(struct_type); present {
-		server.InsertEvents.Lock()
-		server.Events[socket_tag][type_code] = append(server.Events[socket_tag][type_code], function)
-		server.InsertEvents.Unlock()
-	}
+	server.Events[socket_tag][type_code] = append(server.Events[socket_tag][type_code], function)
+	server.InsertEvents.Unlock()
+	return nil
 }
 
 //
 // Create a new callback to be ran when a socket with a certain tag receives
 // a capsule containing a specific type of struct.  The callback accepts a
-// responder which can be used to respond to the client statefully.
+// responder which can be used to respond to the client statefully.  An error
+// is returned if the type is not in the server's TypeStore or the function
+// is nil.
 //
-func (server *Server) AcceptRequest(socket_tag string, struct_type reflect.Type, function func(interface{}, TLBContext)) {
+func (server *Server) AcceptRequest(socket_tag string, struct_type reflect.Type, function func(interface{}, TLBContext)) error {
+	type_code, err := server.callbackCode(struct_type, function)
+	if err != nil {
+		return server.misuse(err)
+	}
+	server.InsertRequests.Lock()
 	if server.Requests[socket_tag] == nil {
 		server.Requests[socket_tag] = make(map[uint16][]func(interface{}, TLBContext))
 	}
-	if type_code, present := server.TypeStore.LookupCode(struct_type); present {
-		server.InsertRequests.Lock()
-		server.Requests[socket_tag][type_code] = append(server.Requests[socket_tag][type_code], function)
-		server.InsertRequests.Unlock()
+	server.Requests[socket_tag][type_code] = append(server.Requests[socket_tag][type_code], function)
+	server.InsertRequests.Unlock()
+	return nil
+}
+
+//
+// Deliver structs received on sockets with a certain tag to their Accept
+// and AcceptRequest callbacks one at a time, in the order they arrived
+// on each socket, instead of in parallel.  If struct types are given
+// only those types are delivered in order.  An error is returned if a
+// type is not in the server's TypeStore.
+//
+func (server *Server) InOrder(socket_tag string, struct_types ...reflect.Type) error {
+	codes, err := server.TypeStore.lookupCodes(struct_types)
+	if err != nil {
+		return server.misuse(err)
+	}
+	server.InsertOrdered.Lock()
+	ordering, present := server.Ordered[socket_tag]
+	if !present {
+		ordering = NewOrdering()
+		server.Ordered[socket_tag] = ordering
+	}
+	server.InsertOrdered.Unlock()
+	ordering.add(codes)
+	return nil
+}
+
+//
+// Report if structs of a type received on sockets with a tag are
+// delivered in order.
+//
+func (server *Server) inOrder(socket_tag string, type_code uint16) bool {
+	server.InsertOrdered.Lock()
+	ordering, present := server.Ordered[socket_tag]
+	server.InsertOrdered.Unlock()
+	return present && ordering.Covers(type_code)
+}
+
+//
+// Use adds interceptors that wrap every Accept and AcceptRequest
+// callback.  The first interceptor added runs first.
+//
+func (server *Server) Use(interceptors ...Interceptor) {
+	server.interceptors.use(interceptors)
+}
+
+//
+// UseOutbound adds interceptors that wrap every context.Respond,
+// server.Send and server.Broadcast.  Broadcasts are intercepted once,
+// not once for each socket.  The first interceptor added runs first.
+//
+func (server *Server) UseOutbound(interceptors ...OutboundInterceptor) {
+	server.interceptors.useOutbound(interceptors)
+}
+
+//
+// Check the arguments to Accept or AcceptRequest, returning the type
+// code the callback should be stored under.
+//
+func (server *Server) callbackCode(struct_type reflect.Type, function func(interface{}, TLBContext)) (uint16, error) {
+	if struct_type == nil {
+		return 0, errors.New("struct type cannot be nil")
+	}
+	if function == nil {
+		return 0, errors.New("function cannot be nil")
+	}
+	return server.typeCode(struct_type)
+}
+
+//
+// Return the code of a type callbacks are being created for, or an
+// error if it is not in the server's TypeStore.
+//
+func (server *Server) typeCode(struct_type reflect.Type) (uint16, error) {
+	type_code, present := server.TypeStore.LookupCode(struct_type)
+	if !present {
+		return 0, errors.New("type " + struct_type.String() + " not in type store")
+	}
+	return type_code, nil
+}
+
+//
+// Return an error from misusing the server, or panic with it if the
+// server is Strict.
+//
+func (server *Server) misuse(err error) error {
+	if server.Strict {
+		panic(err)
 	}
+	return err
 }
 
 //
@@ -86,6 +228,7 @@ func (server *Server) AcceptRequest(socket_tag string, struct_type reflect.Type,
 //
 func (server *Server) TagSocket(socket net.Conn, tag string) {
 	server.TagManipulation.Lock()
+	server.addConnection(socket)
 	server.Tags[socket] = append(server.Tags[socket], tag)
 	server.Sockets[tag] = append(server.Sockets[tag], socket)
 	server.TagManipulation.Unlock()
@@ -141,7 +284,9 @@ func (server *Server) process() {
 	for {
 		socket, err := server.Listener.Accept()
 		if err != nil {
-			server.FailedServer <- err
+			if !server.closing() {
+				server.FailedServer <- err
+			}
 			return
 		}
 		server.Insert(socket)
@@ -152,12 +297,18 @@ func (server *Server) process() {
 // Tag the socket then read an structs from this socket until the socket is closed.
 //
 func (server *Server) Insert(socket net.Conn) {
+	server.TagManipulation.Lock()
+	server.addConnection(socket).reading = true
+	server.TagManipulation.Unlock()
 	server.Tag(socket, server)
 	go server.readStructs(socket)
 }
 
 //
-// Remove all tags from a socket, removing it from the server.
+// Remove all tags from a socket, removing it from the server.  The
+// socket's Connection is forgotten as well, unless the server is
+// reading from the socket, in which case it is forgotten once reading
+// stops.
 //
 func (server *Server) Delete(socket net.Conn) {
 	server.TagManipulation.Lock()
@@ -171,6 +322,9 @@ func (server *Server) Delete(socket net.Conn) {
 			delete(server.Tags, socket)
 		}
 	}
+	if connection, present := server.Connections[socket]; present && !connection.reading {
+		delete(server.Connections, socket)
+	}
 	server.TagManipulation.Unlock()
 }
 
@@ -178,31 +332,211 @@ func (server *Server) Delete(socket net.Conn) {
 // Read structs from a socket until the socket is closed, running any relevant callbacks.
 //
 func (server *Server) readStructs(socket net.Conn) {
+	defer server.removeConnection(socket)
 	defer socket.Close()
 	context := TLBContext{
-		Server: server,
-		Socket: socket,
+		Server:  server,
+		Socket:  socket,
+		Context: context.Background(),
 	}
+	connection := server.Connection(socket)
+	beats := make(chan struct{}, 1)
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go server.Heartbeat.monitor(socket, beats, stopped, func(ping HeartbeatPing) error {
+		return server.send(connection, ping)
+	}, connection.Fail)
+	read_deadline := false
 	for {
+		server.Heartbeat.setReadDeadline(socket, &read_deadline)
 		obj, err := server.TypeStore.NextStruct(socket, context)
+		if handler_panic, ok := err.(*HandlerPanic); ok {
+			if server.panics.report(handler_panic) {
+				server.dropSocket(socket, handler_panic)
+				return
+			}
+			continue
+		}
+		if _, ok := err.(*UnknownType); ok {
+			beat(beats)
+			continue
+		}
 		if err != nil {
-			server.FailedSockets <- socket
-			server.Delete(socket)
+			server.dropSocket(socket, connection.reason(err))
 			return
 		}
+		beat(beats)
 		server.TagManipulation.Lock()
 		tags := server.Tags[socket]
 		server.TagManipulation.Unlock()
-		if obj == nil {
+		switch received := obj.(type) {
+		case nil:
+			continue
+		case *Hello:
+			if received.Reply {
+				continue
+			}
+			handshake, err := server.handshake(connection, received)
+			if err != nil {
+				server.dropSocket(socket, err)
+				return
+			}
+			context.Handshake = handshake
+		case *HeartbeatPing:
+			server.send(connection, HeartbeatPong{ID: received.ID})
+		case *HeartbeatPong:
 			continue
-		} else if reflect.TypeOf(obj) == reflect.TypeOf(&Capsule{}) {
-			server.runRequestCallbacks(obj, tags, context)
-		} else {
-			server.runEventCallbacks(obj, tags, context)
+		case *Capsule, *WideCapsule:
+			server.dispatch(func() {
+				server.runRequestCallbacks(obj, tags, context)
+			})
+		case *StreamFrame:
+			server.handleStreamFrame(received, tags, context)
+		case *Cancel:
+			connection.cancelRequest(received.RequestID)
+		default:
+			server.dispatch(func() {
+				server.runEventCallbacks(obj, tags, context)
+			})
+		}
+	}
+}
+
+//
+// Start callbacks with a function unless the server is shutting down,
+// in which case the struct is dropped.  The lock is only held to add
+// to server.Running, since submitting a callback can block until the
+// Dispatcher has room and Shutdown must still be able to start.
+//
+func (server *Server) dispatch(start func()) {
+	server.Dispatching.RLock()
+	if server.closing() {
+		server.Dispatching.RUnlock()
+		return
+	}
+	server.Running.Add(1)
+	server.Dispatching.RUnlock()
+	defer server.Running.Done()
+	start()
+}
+
+//
+// Run a callback with the server's Dispatcher, which server.Shutdown
+// will wait for.  The socket is closed if its queue overflowed.  If
+// finished is not nil it is called once the callback returns or when
+// the callback will never run.
+//
+func (server *Server) run(function func(interface{}, TLBContext), obj interface{}, context TLBContext, ordered bool, finished func()) {
+	server.Running.Add(1)
+	handler := server.interceptors.wrap(function)
+	job := func() {
+		defer server.Running.Done()
+		if finished != nil {
+			defer finished()
+		}
+		defer server.recoverPanic(context.Socket)
+		handler(obj, context)
+	}
+	var err error
+	if ordered {
+		err = server.Dispatcher.SubmitOrdered(context.Socket, job)
+	} else {
+		err = server.Dispatcher.Submit(context.Socket, job)
+	}
+	if err != nil {
+		server.Running.Done()
+		if finished != nil {
+			finished()
+		}
+		if err == ErrQueueOverflow {
+			context.Socket.Close()
 		}
 	}
 }
 
+//
+// Recover from a panic in a callback, passing it to the hook set with
+// server.OnHandlerPanic and closing the socket if asked to.  Must be
+// deferred.
+//
+func (server *Server) recoverPanic(socket net.Conn) {
+	if value := recover(); value != nil {
+		if server.panics.report(newHandlerPanic(value, socket)) {
+			socket.Close()
+		}
+	}
+}
+
+//
+// OnHandlerPanic sets a hook that is run when an Accept or AcceptRequest
+// callback or a Builder panics.  The panic is recovered either way, and
+// if drop is set the socket the struct was received on is closed.
+//
+func (server *Server) OnHandlerPanic(hook func(HandlerPanic), drop bool) {
+	server.panics.set(hook, drop)
+}
+
+//
+// Report if server.Shutdown has been called.
+//
+func (server *Server) closing() bool {
+	select {
+	case <-server.Closing:
+		return true
+	default:
+		return false
+	}
+}
+
+//
+// Remove a socket that failed from the server, reporting it on
+// FailedSockets, and with the reason it failed on SocketErrors if
+// there is room, unless the server is shutting down.
+//
+func (server *Server) dropSocket(socket net.Conn, err error) {
+	if !server.closing() {
+		server.FailedSockets <- socket
+		select {
+		case server.SocketErrors <- SocketError{Socket: socket, Err: err}:
+		default:
+		}
+	}
+	server.Delete(socket)
+}
+
+//
+// Format a struct and write it to a Connection.
+//
+func (server *Server) send(connection *Connection, instance interface{}) error {
+	message, err := server.TypeStore.Format(instance)
+	if err != nil {
+		return err
+	}
+	return connection.Write(message)
+}
+
+//
+// Answer a Hello sent by a client on a Connection with this server's
+// own Hello, including an error if the client's Hello was not
+// acceptable.
+//
+func (server *Server) handshake(connection *Connection, hello *Hello) (*Handshake, error) {
+	handshake, err := server.TypeStore.negotiate(hello)
+	reply := server.TypeStore.hello(true)
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	reply_bytes, format_err := server.TypeStore.Format(reply)
+	if format_err != nil {
+		return nil, format_err
+	}
+	write_err := connection.Write(reply_bytes)
+	if err == nil {
+		err = write_err
+	}
+	return handshake, err
+}
+
 //
 // Run all functions stored during server.Accept calls
 //
@@ -215,8 +549,9 @@ func (server *Server) runEventCallbacks(obj interface{}, tags []string, context
 		if server.Events[tag][recieved_type] == nil {
 			continue
 		}
+		ordered := server.inOrder(tag, recieved_type)
 		for _, function := range server.Events[tag][recieved_type] {
-			go function(obj, context)
+			server.run(function, obj, context, ordered, nil)
 		}
 	}
 }
@@ -225,42 +560,163 @@ func (server *Server) runEventCallbacks(obj interface{}, tags []string, context
 // Run all functions stored during server.AcceptRequest calls
 //
 func (server *Server) runRequestCallbacks(obj interface{}, tags []string, context TLBContext) {
-	if capsule, ok := obj.(*Capsule); ok {
-		for _, tag := range tags {
-			if server.Requests[tag][capsule.Type] == nil {
-				continue
+	var capsule *WideCapsule
+	wide := false
+	switch received := obj.(type) {
+	case *Capsule:
+		capsule = received.Widen()
+	case *WideCapsule:
+		capsule = received
+		wide = true
+	default:
+		return
+	}
+	struct_type, present := context.Handshake.LocalCode(capsule.Type)
+	if !present {
+		return
+	}
+	callbacks := 0
+	for _, tag := range tags {
+		callbacks += len(server.Requests[tag][struct_type])
+	}
+	if callbacks == 0 {
+		return
+	}
+	connection := server.Connection(context.Socket)
+	if connection == nil {
+		return
+	}
+	request_context, running := connection.startRequest(capsule.RequestID, context.Context, callbacks)
+	context.Context = request_context
+	finished := func() {
+		connection.finishRequest(capsule.RequestID, running)
+	}
+	for _, tag := range tags {
+		if server.Requests[tag][struct_type] == nil {
+			continue
+		}
+		ordered := server.inOrder(tag, struct_type)
+		functions := server.Requests[tag][struct_type]
+		for index, function := range functions {
+			responder := Responder{
+				RequestID: capsule.RequestID,
+				Wide:      wide,
+				Reply:     context.Responder.Reply,
 			}
-			for _, function := range server.Requests[tag][capsule.Type] {
-				responder := Responder{
-					RequestID: capsule.RequestID,
-					WriteLock: sync.Mutex{},
+			context.Responder = responder
+			recieved_struct, err := server.TypeStore.buildType(struct_type, []byte(capsule.Data), context)
+			if handler_panic, ok := err.(*HandlerPanic); ok {
+				if server.panics.report(handler_panic) {
+					connection.stopRequest(capsule.RequestID, running)
+					context.Socket.Close()
+					return
 				}
-				context.Responder = responder
-				recieved_struct := server.TypeStore.BuildType(capsule.Type, []byte(capsule.Data), context)
-				if recieved_struct != nil {
-					go function(recieved_struct, context)
+				for range functions[index:] {
+					finished()
 				}
+				break
+			}
+			if recieved_struct != nil {
+				server.run(function, recieved_struct, context, ordered, finished)
+			} else {
+				finished()
 			}
 		}
 	}
 }
 
+//
+// A GoAway is sent to every tagged socket when a server with SendGoAway
+// set is shut down.  Clients receive it on client.GoAways.
+//
+type GoAway struct {
+	Reason string
+}
+
+//
+// Shutdown stops the server from accepting new connections and from
+// running callbacks for structs it receives, sends a GoAway to every
+// tagged socket if server.SendGoAway is set, waits for running Accept
+// and AcceptRequest callbacks to return, and then closes every tagged
+// socket.  If the context is done before the callbacks return the
+// sockets are closed anyway, callbacks still waiting for room in the
+// Dispatcher are dropped, and the context's error is returned.
+//
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.Dispatching.Lock()
+	if server.closing() {
+		server.Dispatching.Unlock()
+		return errors.New("server already shut down")
+	}
+	close(server.Closing)
+	server.Dispatching.Unlock()
+	server.Listener.Close()
+
+	server.TagManipulation.Lock()
+	sockets := make([]net.Conn, 0, len(server.Tags))
+	for socket := range server.Tags {
+		sockets = append(sockets, socket)
+	}
+	server.TagManipulation.Unlock()
+
+	if server.SendGoAway {
+		go_away, err := server.TypeStore.Format(GoAway{
+			Reason: "server shutting down",
+		})
+		if err == nil {
+			for _, socket := range sockets {
+				if connection := server.Connection(socket); connection != nil {
+					connection.Write(go_away)
+				}
+			}
+		}
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		server.Running.Wait()
+		close(drained)
+	}()
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	server.Dispatcher.Stop()
+
+	for _, socket := range sockets {
+		socket.Close()
+	}
+	return err
+}
+
 //
 // Context about TLB events so Server callbacks can respond statefully
 // and Builders can conditionally validate data and verify signatures.
+// Interceptors can carry values to callbacks in Context.  For
+// AcceptRequest callbacks, Context is cancelled when the client cancels
+// the request, when the socket closes, or once every callback for the
+// request has returned.
 //
 type TLBContext struct {
 	Server    *Server
 	Socket    net.Conn
 	Responder Responder
+	Handshake *Handshake
+	Context   context.Context
 }
 
 //
-// Responders contain information needed to send a stateful response
+// Responders contain information needed to send a stateful response.
+// Wide is set when the request arrived in a WideCapsule, so the
+// response is sent in one as well.  Reply is set when the request
+// came from a Peer, which expects its responses in a Reply.
 //
 type Responder struct {
-	RequestID uint16
-	WriteLock sync.Mutex
+	RequestID uint32
+	Wide      bool
+	Reply     bool
 }
 
 //
@@ -268,19 +724,40 @@ type Responder struct {
 // with client.Request
 //
 func (context *TLBContext) Respond(object interface{}) error {
-	response_bytes, err := context.Server.TypeStore.FormatCapsule(object, context.Responder.RequestID)
-	if err != nil {
-		return err
-	}
+	return context.Server.interceptors.wrapSender(context.respond)(object)
+}
 
-	context.Responder.WriteLock.Lock()
-	_, err = context.Socket.Write(response_bytes)
-	context.Responder.WriteLock.Unlock()
+//
+// Write a response without running any outbound interceptors.
+//
+func (context *TLBContext) respond(object interface{}) error {
+	var response_bytes []byte
+	var err error
+	if context.Responder.Reply {
+		response_bytes, err = context.Server.TypeStore.FormatReply(object, context.Responder.RequestID)
+	} else if context.Responder.Wide {
+		response_bytes, err = context.Server.TypeStore.FormatWideCapsule(object, context.Responder.RequestID)
+	} else {
+		response_bytes, err = context.Server.TypeStore.FormatCapsule(object, uint16(context.Responder.RequestID))
+	}
 	if err != nil {
-		context.Server.FailedSockets <- context.Socket
-		context.Server.Delete(context.Socket)
 		return err
 	}
 
-	return err
+	return context.Server.write(context.Socket, response_bytes)
+}
+
+//
+// RespondError is used to tell the client that sent a request that it
+// failed.  If err is an ErrorResponse it is sent as is, otherwise it is
+// sent as an ErrorResponse with the error's message.
+//
+func (context *TLBContext) RespondError(err error) error {
+	var response ErrorResponse
+	if !errors.As(err, &response) {
+		response = ErrorResponse{
+			Message: err.Error(),
+		}
+	}
+	return context.Respond(response)
 }
@@ -1,6 +1,7 @@
 package tlb_test
 
 import (
+	"context"
 	"fmt"
 	. "github.com/hkparker/TLB"
 	. "github.com/onsi/ginkgo"
@@ -8,13 +9,68 @@ import (
 	"gopkg.in/mgo.v2/bson"
 	"net"
 	"reflect"
-	"sync"
+	"time"
 )
 
 func TagSocketAll(socket net.Conn, server *Server) {
 	server.TagSocket(socket, "all")
 }
 
+//
+// A testServer is a Server listening on localhost with a TypeStore
+// holding Thingy, and a context that ends after five seconds.  Clients
+// dialed with testServer.dial are closed once the spec ends.
+//
+type testServer struct {
+	typeStore TypeStore
+	listener  net.Listener
+	server    Server
+	ctx       context.Context
+	cancel    context.CancelFunc
+	clients   []Client
+}
+
+//
+// Start a new testServer before each spec in the enclosing Describe and
+// stop it afterwards.  Each of add_types is run on the TypeStore before
+// the Server is created.
+//
+func useTestServer(add_types ...func(TypeStore)) *testServer {
+	test_server := &testServer{}
+	BeforeEach(func() {
+		test_server.typeStore = NewTypeStore()
+		test_server.typeStore.AddType(reflect.TypeOf(Thingy{}), reflect.TypeOf(&Thingy{}), BuildThingy)
+		for _, add_type := range add_types {
+			add_type(test_server.typeStore)
+		}
+		var err error
+		test_server.listener, err = net.Listen("tcp", "localhost:0")
+		Expect(err).To(BeNil())
+		test_server.server = NewServer(test_server.listener, TagSocketAll, test_server.typeStore)
+		test_server.ctx, test_server.cancel = context.WithTimeout(context.Background(), 5*time.Second)
+		test_server.clients = nil
+	})
+	AfterEach(func() {
+		for _, client := range test_server.clients {
+			client.Close()
+		}
+		test_server.cancel()
+		test_server.listener.Close()
+	})
+	return test_server
+}
+
+//
+// Dial the testServer with a new Client.
+//
+func (test_server *testServer) dial() Client {
+	client_socket, err := net.Dial("tcp", test_server.listener.Addr().String())
+	Expect(err).To(BeNil())
+	client := NewClient(client_socket, test_server.typeStore, false)
+	test_server.clients = append(test_server.clients, client)
+	return client
+}
+
 var _ = Describe("Server", func() {
 
 	var (
@@ -76,6 +132,43 @@ var _ = Describe("Server", func() {
 		})
 	})
 
+	Describe("Accept errors", func() {
+		It("returns an error when the type is not in the type store", func() {
+			listener, err := net.Listen("tcp", "localhost:0")
+			Expect(err).To(BeNil())
+			defer listener.Close()
+			server := NewServer(listener, TagSocketAll, type_store)
+			err = server.Accept("all", reflect.TypeOf(Thingy{}), func(_ interface{}, _ TLBContext) {})
+			Expect(err).ToNot(BeNil())
+			err = server.AcceptRequest("all", reflect.TypeOf(Thingy{}), func(_ interface{}, _ TLBContext) {})
+			Expect(err).ToNot(BeNil())
+			Expect(server.Events["all"]).To(BeNil())
+			Expect(server.Requests["all"]).To(BeNil())
+		})
+
+		It("returns an error when the function is nil", func() {
+			listener, err := net.Listen("tcp", "localhost:0")
+			Expect(err).To(BeNil())
+			defer listener.Close()
+			server := NewServer(listener, TagSocketAll, populated_type_store)
+			err = server.Accept("all", reflect.TypeOf(Thingy{}), nil)
+			Expect(err).ToNot(BeNil())
+			err = server.AcceptRequest("all", reflect.TypeOf(Thingy{}), nil)
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("panics when the server is strict", func() {
+			listener, err := net.Listen("tcp", "localhost:0")
+			Expect(err).To(BeNil())
+			defer listener.Close()
+			server := NewServer(listener, TagSocketAll, type_store)
+			server.Strict = true
+			Expect(func() {
+				server.Accept("all", reflect.TypeOf(Thingy{}), func(_ interface{}, _ TLBContext) {})
+			}).To(Panic())
+		})
+	})
+
 	Describe("AcceptRequest", func() {
 		It("can run accept request callbacks", func() {
 			listener, err := net.Listen("tcp", "localhost:0")
@@ -188,6 +281,99 @@ var _ = Describe("Server", func() {
 		})
 	})
 
+	Describe("Shutdown", func() {
+		It("waits for running callbacks before closing sockets", func() {
+			listener, err := net.Listen("tcp", "localhost:0")
+			Expect(err).To(BeNil())
+			server := NewServer(listener, TagSocketAll, populated_type_store)
+			server.SendGoAway = true
+			started := make(chan bool)
+			finished := make(chan bool, 1)
+			server.Accept("all", reflect.TypeOf(Thingy{}), func(_ interface{}, _ TLBContext) {
+				started <- true
+				time.Sleep(200 * time.Millisecond)
+				finished <- true
+			})
+			client_socket, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).To(BeNil())
+			defer client_socket.Close()
+			client := NewClient(client_socket, populated_type_store, false)
+			err = client.Message(thingy)
+			Expect(err).To(BeNil())
+			<-started
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err = server.Shutdown(ctx)
+			Expect(err).To(BeNil())
+			Expect(len(finished)).To(Equal(1))
+			go_away := <-client.GoAways
+			Expect(go_away.Reason).ToNot(BeEmpty())
+			<-client.Done()
+			Expect(client.Err()).ToNot(BeNil())
+			_, err = net.Dial("tcp", listener.Addr().String())
+			Expect(err).ToNot(BeNil())
+			Expect(server.Shutdown(ctx)).ToNot(BeNil())
+		})
+
+		It("returns the context error when callbacks do not finish", func() {
+			listener, err := net.Listen("tcp", "localhost:0")
+			Expect(err).To(BeNil())
+			server := NewServer(listener, TagSocketAll, populated_type_store)
+			started := make(chan bool)
+			release := make(chan bool)
+			server.Accept("all", reflect.TypeOf(Thingy{}), func(_ interface{}, _ TLBContext) {
+				started <- true
+				<-release
+			})
+			defer close(release)
+			client_socket, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).To(BeNil())
+			defer client_socket.Close()
+			client := NewClient(client_socket, populated_type_store, false)
+			err = client.Message(thingy)
+			Expect(err).To(BeNil())
+			<-started
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			err = server.Shutdown(ctx)
+			Expect(err).To(Equal(context.DeadlineExceeded))
+			<-client.Done()
+			Expect(client.Err()).ToNot(BeNil())
+		})
+		It("returns the context error while a reader waits for room in the Dispatcher", func() {
+			listener, err := net.Listen("tcp", "localhost:0")
+			Expect(err).To(BeNil())
+			server := NewServer(listener, TagSocketAll, populated_type_store)
+			server.Dispatcher.Configure(1, 1, OverflowBlock)
+			started := make(chan bool, 3)
+			release := make(chan bool)
+			server.Accept("all", reflect.TypeOf(Thingy{}), func(_ interface{}, _ TLBContext) {
+				started <- true
+				<-release
+			})
+			defer close(release)
+			client_socket, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).To(BeNil())
+			defer client_socket.Close()
+			client := NewClient(client_socket, populated_type_store, false)
+			for i := 0; i < 3; i++ {
+				Expect(client.Message(thingy)).To(BeNil())
+			}
+			<-started
+			Eventually(func() int {
+				return server.Dispatcher.Stats().Running
+			}).Should(Equal(1))
+			time.Sleep(50 * time.Millisecond)
+			shut_down := make(chan error, 1)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+				defer cancel()
+				shut_down <- server.Shutdown(ctx)
+			}()
+			Eventually(shut_down, 2*time.Second).Should(Receive(Equal(context.DeadlineExceeded)))
+		})
+	})
+
 	Describe("TLBContext", func() {
 		It("can be used to send a response", func() {
 			listener, err := net.Listen("tcp", "localhost:0")
@@ -205,7 +391,6 @@ var _ = Describe("Server", func() {
 			server := NewServer(listener, TagSocketAll, populated_type_store)
 			responder := Responder{
 				RequestID: 1,
-				WriteLock: sync.Mutex{},
 			}
 			context := TLBContext{
 				Server:    &server,
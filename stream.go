@@ -0,0 +1,215 @@
+package tlb
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+)
+
+//
+// ErrStreamClosed is returned when sending on a StreamSender that has
+// already been closed, or reading from a ResponseStream after
+// stream.Close.
+//
+var ErrStreamClosed = errors.New("stream closed")
+
+//
+// StreamBuffer is how many responses a ResponseStream holds before the
+// client stops handling further responses in order until stream.Next
+// is called.
+//
+const StreamBuffer = 16
+
+//
+// An EndOfStream is sent by stream.Close after the last response to a
+// request, with the number of responses that were sent.
+//
+type EndOfStream struct {
+	Count int
+}
+
+//
+// A StreamSender sends any number of responses to one request, which
+// a client reads with client.RequestStream.
+//
+type StreamSender struct {
+	context      TLBContext
+	sent         int
+	closed       bool
+	manipulation *sync.Mutex
+}
+
+//
+// Stream returns a StreamSender for responding to the request this
+// context was created for more than once.  The stream must be ended
+// with stream.Close or stream.CloseWithError.
+//
+func (context *TLBContext) Stream() *StreamSender {
+	return &StreamSender{
+		context:      *context,
+		manipulation: &sync.Mutex{},
+	}
+}
+
+//
+// Send writes one response to the stream, as context.Respond does.
+//
+func (stream *StreamSender) Send(instance interface{}) error {
+	stream.manipulation.Lock()
+	defer stream.manipulation.Unlock()
+	if stream.closed {
+		return ErrStreamClosed
+	}
+	err := stream.context.Respond(instance)
+	if err == nil {
+		stream.sent += 1
+	}
+	return err
+}
+
+//
+// Close ends the stream with an EndOfStream, after which the client's
+// stream.Next returns io.EOF.
+//
+func (stream *StreamSender) Close() error {
+	stream.manipulation.Lock()
+	defer stream.manipulation.Unlock()
+	if stream.closed {
+		return ErrStreamClosed
+	}
+	stream.closed = true
+	return stream.context.Respond(EndOfStream{
+		Count: stream.sent,
+	})
+}
+
+//
+// CloseWithError ends the stream with an ErrorResponse, as
+// context.RespondError does, which the client's stream.Next returns.
+//
+func (stream *StreamSender) CloseWithError(err error) error {
+	stream.manipulation.Lock()
+	defer stream.manipulation.Unlock()
+	if stream.closed {
+		return ErrStreamClosed
+	}
+	stream.closed = true
+	return stream.context.RespondError(err)
+}
+
+//
+// A ResponseStream reads the responses to a request that the server
+// answers with context.Stream, in the order they were sent.
+//
+type ResponseStream struct {
+	Request Request
+	items   chan streamItem
+	done    chan struct{}
+	closing *sync.Once
+	ctx     context.Context
+	err     error
+}
+
+type streamItem struct {
+	value interface{}
+	err   error
+}
+
+//
+// RequestStream makes a request and returns a ResponseStream of every
+// response of response_type the server sends to it until the server
+// closes the stream, the request fails, or ctx is done.
+//
+func (client *Client) RequestStream(ctx context.Context, instance interface{}, response_type reflect.Type) (*ResponseStream, error) {
+	if _, present := client.TypeStore.LookupCode(response_type); !present {
+		return nil, errors.New("cannot await response type not in type store")
+	}
+	request, err := client.newRequest(instance)
+	if err != nil {
+		return nil, err
+	}
+	client.RequestsManipulation.Lock()
+	if state, present := client.Requests[request.RequestID]; present {
+		state.Stream = true
+	}
+	client.RequestsManipulation.Unlock()
+	stream := &ResponseStream{
+		Request: request,
+		items:   make(chan streamItem, StreamBuffer),
+		done:    make(chan struct{}),
+		closing: &sync.Once{},
+		ctx:     ctx,
+	}
+	request.OnResponse(response_type, func(iface interface{}) {
+		stream.push(streamItem{value: iface})
+	})
+	request.OnResponse(reflect.TypeOf(EndOfStream{}), func(_ interface{}) {
+		stream.push(streamItem{err: io.EOF})
+	})
+	request.OnError(func(err error) {
+		stream.push(streamItem{err: err})
+	})
+	err = client.sendRequest(&stream.Request, instance)
+	if err != nil {
+		request.forget()
+		return nil, err
+	}
+	return stream, nil
+}
+
+//
+// Hold a response or error until stream.Next reads it, unless the
+// stream is closed first.  If the stream's context is done while
+// waiting the stream is closed, so a caller that stopped reading does
+// not hold up the other responses on the connection.
+//
+func (stream *ResponseStream) push(item streamItem) {
+	select {
+	case stream.items <- item:
+	case <-stream.done:
+	case <-stream.ctx.Done():
+		stream.Close()
+	}
+}
+
+//
+// Next returns the next response in the stream, waiting for it to
+// arrive.  io.EOF is returned once the server has closed the stream,
+// and any other error means the stream failed, such as the
+// ErrorResponse sent with stream.CloseWithError.  After an error, Next
+// keeps returning the same error.
+//
+func (stream *ResponseStream) Next() (interface{}, error) {
+	if stream.err != nil {
+		return nil, stream.err
+	}
+	select {
+	case item := <-stream.items:
+		if item.err != nil {
+			stream.err = item.err
+			stream.Close()
+		}
+		return item.value, item.err
+	case <-stream.done:
+		stream.err = ErrStreamClosed
+	case <-stream.ctx.Done():
+		stream.err = stream.ctx.Err()
+		stream.Close()
+	}
+	return nil, stream.err
+}
+
+//
+// Close stops handling responses to the stream's request, cancelling
+// it on the server if the stream has not ended.  It is safe to call
+// more than once, and from another goroutine than the one calling
+// stream.Next.
+//
+func (stream *ResponseStream) Close() {
+	stream.closing.Do(func() {
+		close(stream.done)
+		stream.Request.abandon()
+	})
+}
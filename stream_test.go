@@ -0,0 +1,199 @@
+package tlb_test
+
+import (
+	"context"
+	"errors"
+	. "github.com/hkparker/TLB"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io"
+	"net"
+	"reflect"
+	"time"
+)
+
+var _ = Describe("Streams", func() {
+
+	fixture := useTestServer()
+	dial := fixture.dial
+
+	count := func(iface interface{}, context TLBContext) {
+		if thingy, correct_type := iface.(*Thingy); correct_type {
+			stream := context.Stream()
+			for i := 0; i < thingy.ID; i++ {
+				stream.Send(Thingy{ID: i})
+			}
+			stream.Close()
+		}
+	}
+
+	It("delivers every response in order and then io.EOF", func() {
+		fixture.server.AcceptRequest("all", reflect.TypeOf(Thingy{}), count)
+		client := dial()
+		defer client.Close()
+		stream, err := client.RequestStream(fixture.ctx, Thingy{ID: 100}, reflect.TypeOf(Thingy{}))
+		Expect(err).To(BeNil())
+		defer stream.Close()
+		for i := 0; i < 100; i++ {
+			iface, err := stream.Next()
+			Expect(err).To(BeNil())
+			Expect(iface).To(Equal(&Thingy{ID: i}))
+		}
+		_, err = stream.Next()
+		Expect(err).To(Equal(io.EOF))
+		_, err = stream.Next()
+		Expect(err).To(Equal(io.EOF))
+		client.RequestsManipulation.Lock()
+		Expect(client.Requests).To(BeEmpty())
+		client.RequestsManipulation.Unlock()
+	})
+
+	It("ends an empty stream with io.EOF", func() {
+		fixture.server.AcceptRequest("all", reflect.TypeOf(Thingy{}), count)
+		client := dial()
+		defer client.Close()
+		stream, err := client.RequestStream(fixture.ctx, Thingy{ID: 0}, reflect.TypeOf(Thingy{}))
+		Expect(err).To(BeNil())
+		_, err = stream.Next()
+		Expect(err).To(Equal(io.EOF))
+	})
+
+	It("returns the error a stream was closed with", func() {
+		after_close := make(chan error, 2)
+		fixture.server.AcceptRequest("all", reflect.TypeOf(Thingy{}), func(_ interface{}, context TLBContext) {
+			stream := context.Stream()
+			stream.Send(Thingy{ID: 1})
+			stream.CloseWithError(ErrorResponse{Code: 500, Message: "feed failed"})
+			after_close <- stream.Send(Thingy{ID: 2})
+			after_close <- stream.Close()
+		})
+		client := dial()
+		defer client.Close()
+		stream, err := client.RequestStream(fixture.ctx, Thingy{}, reflect.TypeOf(Thingy{}))
+		Expect(err).To(BeNil())
+		iface, err := stream.Next()
+		Expect(err).To(BeNil())
+		Expect(iface).To(Equal(&Thingy{ID: 1}))
+		_, err = stream.Next()
+		var response ErrorResponse
+		Expect(errors.As(err, &response)).To(BeTrue())
+		Expect(response.Code).To(Equal(500))
+		Eventually(after_close).Should(Receive(Equal(ErrStreamClosed)))
+		Eventually(after_close).Should(Receive(Equal(ErrStreamClosed)))
+	})
+
+	It("fails a stream that is open when the connection closes", func() {
+		sent := make(chan bool)
+		fixture.server.AcceptRequest("all", reflect.TypeOf(Thingy{}), func(_ interface{}, context TLBContext) {
+			context.Stream().Send(Thingy{ID: 1})
+			sent <- true
+		})
+		client := dial()
+		stream, err := client.RequestStream(fixture.ctx, Thingy{}, reflect.TypeOf(Thingy{}))
+		Expect(err).To(BeNil())
+		Eventually(sent).Should(Receive())
+		_, err = stream.Next()
+		Expect(err).To(BeNil())
+		client.Close()
+		_, err = stream.Next()
+		Expect(err).To(Equal(ErrConnectionClosed))
+	})
+
+	It("delivers the responses received before the connection closed ahead of the error", func() {
+		fixture.server.AcceptRequest("all", reflect.TypeOf(Thingy{}), func(_ interface{}, context TLBContext) {
+			stream := context.Stream()
+			for i := 0; i < 3*StreamBuffer; i++ {
+				stream.Send(Thingy{ID: i})
+			}
+			context.Socket.Close()
+		})
+		client := dial()
+		stream, err := client.RequestStream(fixture.ctx, Thingy{}, reflect.TypeOf(Thingy{}))
+		Expect(err).To(BeNil())
+		Eventually(client.Done()).Should(BeClosed())
+		for i := 0; i < 3*StreamBuffer; i++ {
+			iface, err := stream.Next()
+			Expect(err).To(BeNil())
+			Expect(iface).To(Equal(&Thingy{ID: i}))
+		}
+		_, err = stream.Next()
+		Expect(err).To(Equal(ErrConnectionClosed))
+	})
+
+	It("stops waiting when the context is done", func() {
+		fixture.server.AcceptRequest("all", reflect.TypeOf(Thingy{}), func(_ interface{}, context TLBContext) {
+			context.Stream().Send(Thingy{ID: 1})
+		})
+		client := dial()
+		defer client.Close()
+		short, short_cancel := context.WithTimeout(fixture.ctx, 50*time.Millisecond)
+		defer short_cancel()
+		stream, err := client.RequestStream(short, Thingy{}, reflect.TypeOf(Thingy{}))
+		Expect(err).To(BeNil())
+		_, err = stream.Next()
+		Expect(err).To(BeNil())
+		_, err = stream.Next()
+		Expect(err).To(Equal(context.DeadlineExceeded))
+	})
+
+	It("stops holding responses once the context is done without stream.Next", func() {
+		fixture.server.AcceptRequest("all", reflect.TypeOf(Thingy{}), count)
+		client := dial()
+		defer client.Close()
+		abandoned_ctx, abandon := context.WithCancel(fixture.ctx)
+		_, err := client.RequestStream(abandoned_ctx, Thingy{ID: 10 * StreamBuffer}, reflect.TypeOf(Thingy{}))
+		Expect(err).To(BeNil())
+		time.Sleep(50 * time.Millisecond)
+		abandon()
+		stream, err := client.RequestStream(fixture.ctx, Thingy{ID: 1}, reflect.TypeOf(Thingy{}))
+		Expect(err).To(BeNil())
+		iface, err := stream.Next()
+		Expect(err).To(BeNil())
+		Expect(iface).To(Equal(&Thingy{ID: 0}))
+		_, err = stream.Next()
+		Expect(err).To(Equal(io.EOF))
+	})
+
+	It("keeps a stream open past the request timeout once it has started", func() {
+		release := make(chan bool)
+		fixture.server.AcceptRequest("all", reflect.TypeOf(Thingy{}), func(_ interface{}, context TLBContext) {
+			stream := context.Stream()
+			stream.Send(Thingy{ID: 1})
+			<-release
+			stream.Send(Thingy{ID: 2})
+			stream.Close()
+		})
+		client := dial()
+		defer client.Close()
+		client.RequestTimeout = 50 * time.Millisecond
+		stream, err := client.RequestStream(fixture.ctx, Thingy{}, reflect.TypeOf(Thingy{}))
+		Expect(err).To(BeNil())
+		_, err = stream.Next()
+		Expect(err).To(BeNil())
+		time.Sleep(100 * time.Millisecond)
+		release <- true
+		iface, err := stream.Next()
+		Expect(err).To(BeNil())
+		Expect(iface).To(Equal(&Thingy{ID: 2}))
+		_, err = stream.Next()
+		Expect(err).To(Equal(io.EOF))
+	})
+
+	It("streams responses between peers", func() {
+		left_socket, right_socket := net.Pipe()
+		left := NewPeer(left_socket, fixture.typeStore)
+		right := NewPeer(right_socket, fixture.typeStore)
+		defer left.Close()
+		defer right.Close()
+		Expect(right.AcceptRequest(reflect.TypeOf(Thingy{}), count)).To(BeNil())
+		stream, err := left.RequestStream(fixture.ctx, Thingy{ID: 3}, reflect.TypeOf(Thingy{}))
+		Expect(err).To(BeNil())
+		for i := 0; i < 3; i++ {
+			iface, err := stream.Next()
+			Expect(err).To(BeNil())
+			Expect(iface).To(Equal(&Thingy{ID: i}))
+		}
+		_, err = stream.Next()
+		Expect(err).To(Equal(io.EOF))
+	})
+})
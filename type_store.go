@@ -3,7 +3,6 @@ package tlb
 import (
 	"encoding/binary"
 	"errors"
-	"gopkg.in/mgo.v2/bson"
 	"io"
 	"net"
 	"reflect"
@@ -21,9 +20,54 @@ type Capsule struct {
 	Data      string
 }
 
+//
+// A WideCapsule is a Capsule with a 32 bit request ID, used by
+// clients that have enabled WideRequestIDs.  Servers respond to
+// a WideCapsule with a WideCapsule and to a Capsule with a Capsule,
+// so peers that only understand Capsules keep working.
+//
+type WideCapsule struct {
+	RequestID uint32
+	Type      uint16
+	Data      string
+}
+
+//
+// Widen returns the WideCapsule carrying the same request as this
+// Capsule.
+//
+func (capsule *Capsule) Widen() *WideCapsule {
+	return &WideCapsule{
+		RequestID: uint32(capsule.RequestID),
+		Type:      capsule.Type,
+		Data:      capsule.Data,
+	}
+}
+
+//
+// Type codes reserved for the structs TLB itself sends.  Types
+// added with AddType are numbered upward from 1, and reserved
+// types are numbered downward from the top of the range.
+//
+const (
+	CapsuleCode       uint16 = 0
+	WideCapsuleCode   uint16 = 65535
+	HelloCode         uint16 = 65534
+	ErrorResponseCode uint16 = 65533
+	GoAwayCode        uint16 = 65532
+	ReplyCode         uint16 = 65531
+	EndOfStreamCode   uint16 = 65530
+	StreamFrameCode   uint16 = 65529
+	CancelCode        uint16 = 65528
+	HeartbeatPingCode uint16 = 65527
+	HeartbeatPongCode uint16 = 65526
+	MinReservedCode   uint16 = HeartbeatPongCode
+)
+
 //
 // Builders are functions that take the raw payload in the TLV
-// protocol and parse the BSON and run any other validations
+// protocol and parse the BSON, or whatever the TypeStore's Codec
+// produced, and run any other validations
 // that may be nessicary based on the context before returning
 // the struct.
 //
@@ -37,43 +81,123 @@ type Builder func([]byte, TLBContext) interface{}
 type TypeStore struct {
 	Types      map[uint16]Builder
 	TypeCodes  map[reflect.Type]uint16
+	Names      map[uint16]string
+	Codec      Codec
 	NextID     uint16
 	InsertType *sync.Mutex
+	Strict     bool
 }
 
 //
-// Create a new TypeStore with type 0 being a Capsule.
+// Create a new TypeStore with type 0 being a Capsule and the
+// reserved codes holding the other structs TLB sends.  Structs
+// are serialized with BSON.
 //
 func NewTypeStore() TypeStore {
+	return NewTypeStoreWithCodec(BSONCodec{})
+}
+
+//
+// Create a new TypeStore that serializes structs with a Codec other
+// than BSON.  Every peer this TypeStore is used with must use the
+// same Codec.  Setting type_store.Strict makes errors adding types
+// panic, so they are caught as soon as the program starts.
+//
+func NewTypeStoreWithCodec(codec Codec) TypeStore {
 	type_store := TypeStore{
 		Types:      make(map[uint16]Builder),
 		TypeCodes:  make(map[reflect.Type]uint16),
+		Names:      make(map[uint16]string),
+		Codec:      codec,
 		NextID:     1,
 		InsertType: &sync.Mutex{},
 	}
 
-	capsule_builder := func(data []byte, _ TLBContext) interface{} {
-		capsule := &Capsule{}
-		err := bson.Unmarshal(data, &capsule)
+	type_store.addReservedType(CapsuleCode, Capsule{}, codec)
+	type_store.addReservedType(WideCapsuleCode, WideCapsule{}, codec)
+	type_store.addReservedType(HelloCode, Hello{}, BSONCodec{})
+	type_store.addReservedType(ErrorResponseCode, ErrorResponse{}, codec)
+	type_store.addReservedType(GoAwayCode, GoAway{}, codec)
+	type_store.addReservedType(ReplyCode, Reply{}, codec)
+	type_store.addReservedType(EndOfStreamCode, EndOfStream{}, codec)
+	type_store.addReservedType(StreamFrameCode, StreamFrame{}, codec)
+	type_store.addReservedType(CancelCode, Cancel{}, codec)
+	type_store.addReservedType(HeartbeatPingCode, HeartbeatPing{}, codec)
+	type_store.addReservedType(HeartbeatPongCode, HeartbeatPong{}, codec)
+
+	return type_store
+}
+
+//
+// Insert one of the structs TLB sends under its reserved code, with
+// a Builder that unmarshals it using codec.
+//
+func (store *TypeStore) addReservedType(code uint16, instance interface{}, codec Codec) {
+	inst_type := reflect.TypeOf(instance)
+	store.Types[code] = func(data []byte, _ TLBContext) interface{} {
+		built := reflect.New(inst_type).Interface()
+		err := codec.Unmarshal(data, built)
 		if err != nil {
 			return nil
 		}
-		return capsule
+		return built
 	}
-	type_store.Types[0] = capsule_builder
-	type_store.TypeCodes[reflect.TypeOf(Capsule{})] = 0
-	type_store.TypeCodes[reflect.TypeOf(&Capsule{})] = 0
+	store.TypeCodes[inst_type] = code
+	store.TypeCodes[reflect.PtrTo(inst_type)] = code
+	store.Names[code] = TypeName(inst_type)
+}
 
-	return type_store
+//
+// TypeName returns the name a type is registered under by AddType,
+// which is the import path of its package followed by its name.
+//
+func TypeName(struct_type reflect.Type) string {
+	return struct_type.PkgPath() + "." + struct_type.Name()
 }
 
 //
 // Insert a new type into the TypeStore by providing a reflect.Type
 // of the struct and a pointer to the struct, as well as the Builder
-// that will be used to construct the type.  Types must be BSON
-// serializable.
+// that will be used to construct the type.  Types must be serializable
+// by the TypeStore's Codec.  The type is named with TypeName.
 //
 func (store *TypeStore) AddType(inst_type reflect.Type, ptr_type reflect.Type, builder Builder) error {
+	if inst_type == nil {
+		return store.misuse(errors.New("instance type cannot be nil"))
+	}
+	return store.AddNamedType(TypeName(inst_type), inst_type, ptr_type, builder)
+}
+
+//
+// Return an error from misusing the TypeStore, or panic with it if
+// the TypeStore is Strict.
+//
+func (store *TypeStore) misuse(err error) error {
+	if store.Strict && err != nil {
+		panic(err)
+	}
+	return err
+}
+
+//
+// Insert a new type into the TypeStore under an explicit name.  Peers
+// that complete a handshake match types by name rather than by the
+// order they were added in, so the name should stay the same as the
+// type evolves and must be the same in every program using the type.
+// Each type and name can only be added once.
+//
+func (store *TypeStore) AddNamedType(name string, inst_type reflect.Type, ptr_type reflect.Type, builder Builder) error {
+	return store.misuse(store.addNamedType(name, inst_type, ptr_type, builder))
+}
+
+//
+// Insert a new type into the TypeStore, returning any error without
+// considering if the TypeStore is Strict.
+//
+func (store *TypeStore) addNamedType(name string, inst_type reflect.Type, ptr_type reflect.Type, builder Builder) error {
+	if name == "" {
+		return errors.New("type name cannot be empty")
+	}
 	if inst_type == nil {
 		return errors.New("instance type cannot be nil")
 	}
@@ -83,16 +207,83 @@ func (store *TypeStore) AddType(inst_type reflect.Type, ptr_type reflect.Type, b
 	if builder == nil {
 		return errors.New("builder cannot be nil")
 	}
+	store.InsertType.Lock()
+	defer store.InsertType.Unlock()
+	if store.NextID >= MinReservedCode {
+		return errors.New("no type codes left in type store")
+	}
+	if _, present := store.TypeCodes[inst_type]; present {
+		return errors.New("type " + inst_type.String() + " already in type store")
+	}
+	if _, present := store.TypeCodes[ptr_type]; present {
+		return errors.New("type " + ptr_type.String() + " already in type store")
+	}
+	for _, existing := range store.Names {
+		if existing == name {
+			return errors.New("type name " + name + " already in type store")
+		}
+	}
 	type_id := store.NextID
 	store.NextID = store.NextID + 1
-	store.InsertType.Lock()
 	store.Types[type_id] = builder
 	store.TypeCodes[inst_type] = type_id
 	store.TypeCodes[ptr_type] = type_id
-	store.InsertType.Unlock()
+	store.Names[type_id] = name
 	return nil
 }
 
+//
+// Validators are run by the Builders Register creates after a struct
+// has been unmarshalled.  Returning an error discards the struct.
+//
+type Validator func(interface{}, TLBContext) error
+
+//
+// Register inserts the type of instance into the TypeStore with a
+// Builder that unmarshals it with the TypeStore's Codec and then
+// runs any validators on the result.  The type is named with
+// TypeName.  Use AddType when a custom Builder is needed.
+//
+func (store *TypeStore) Register(instance interface{}, validators ...Validator) error {
+	if instance == nil {
+		return store.misuse(errors.New("instance cannot be nil"))
+	}
+	inst_type := reflect.TypeOf(instance)
+	if inst_type.Kind() == reflect.Ptr {
+		inst_type = inst_type.Elem()
+	}
+	return store.RegisterNamed(TypeName(inst_type), instance, validators...)
+}
+
+//
+// RegisterNamed is Register with an explicit type name, as with
+// AddNamedType.
+//
+func (store *TypeStore) RegisterNamed(name string, instance interface{}, validators ...Validator) error {
+	if instance == nil {
+		return store.misuse(errors.New("instance cannot be nil"))
+	}
+	inst_type := reflect.TypeOf(instance)
+	if inst_type.Kind() == reflect.Ptr {
+		inst_type = inst_type.Elem()
+	}
+	codec := store.Codec
+	builder := func(data []byte, context TLBContext) interface{} {
+		built := reflect.New(inst_type).Interface()
+		err := codec.Unmarshal(data, built)
+		if err != nil {
+			return nil
+		}
+		for _, validator := range validators {
+			if validator(built, context) != nil {
+				return nil
+			}
+		}
+		return built
+	}
+	return store.AddNamedType(name, inst_type, reflect.PtrTo(inst_type), builder)
+}
+
 //
 // Given the reflect.Type of a type in the TypeStore, return
 // the uint16 that is used to identify this type over the
@@ -104,30 +295,69 @@ func (store *TypeStore) LookupCode(struct_type reflect.Type) (uint16, bool) {
 	return val, present
 }
 
+//
+// Look up the codes for several types, returning an error if any of
+// them are not in the type store.
+//
+func (store *TypeStore) lookupCodes(struct_types []reflect.Type) ([]uint16, error) {
+	codes := make([]uint16, 0, len(struct_types))
+	for _, struct_type := range struct_types {
+		if struct_type == nil {
+			return nil, errors.New("struct type cannot be nil")
+		}
+		code, present := store.LookupCode(struct_type)
+		if !present {
+			return nil, errors.New("type " + struct_type.String() + " not in type store")
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
 //
 // Call the Builder function for a given type on some data if
 // the type exists in the type store, return nil if the type
-// does not exist.
+// does not exist or the Builder panics.
 //
 func (store *TypeStore) BuildType(struct_code uint16, data []byte, context TLBContext) interface{} {
+	recieved_struct, _ := store.buildType(struct_code, data, context)
+	return recieved_struct
+}
+
+//
+// Call the Builder function for a given type, recovering from a panic
+// in the Builder and returning it as a *HandlerPanic.
+//
+func (store *TypeStore) buildType(struct_code uint16, data []byte, context TLBContext) (recieved_struct interface{}, err error) {
 	function, present := store.Types[struct_code]
 	if !present {
-		return nil
+		return nil, nil
 	}
-	return function(data, context)
+	defer func() {
+		if value := recover(); value != nil {
+			recieved_struct = nil
+			err = newHandlerPanic(value, context.Socket)
+		}
+	}()
+	return function(data, context), nil
 }
 
 //
-// Take any BSON serializable struct that is in the TypeStore
-// and return the byte sequence to send on the network to deliver
-// the struct to the other instance of TLB, as well as any errors.
+// Return the Codec used to serialize structs with a type code.
 //
-func (store *TypeStore) Format(instance interface{}) ([]byte, error) {
-	bytes, err := bson.Marshal(instance)
-	if err != nil {
-		return nil, err
+func (store *TypeStore) codecFor(struct_type uint16) Codec {
+	if struct_type == HelloCode {
+		return BSONCodec{}
 	}
+	return store.Codec
+}
 
+//
+// Take any struct that is in the TypeStore and serializable by its
+// Codec and return the byte sequence to send on the network to deliver
+// the struct to the other instance of TLB, as well as any errors.
+//
+func (store *TypeStore) Format(instance interface{}) ([]byte, error) {
 	type_bytes := make([]byte, 2)
 	struct_type, present := store.LookupCode(reflect.TypeOf(instance))
 	if !present {
@@ -135,6 +365,11 @@ func (store *TypeStore) Format(instance interface{}) ([]byte, error) {
 	}
 	binary.LittleEndian.PutUint16(type_bytes, struct_type)
 
+	bytes, err := store.codecFor(struct_type).Marshal(instance)
+	if err != nil {
+		return nil, err
+	}
+
 	length := len(bytes)
 	length_bytes := make([]byte, 4)
 	binary.LittleEndian.PutUint32(length_bytes, uint32(length))
@@ -149,17 +384,41 @@ func (store *TypeStore) Format(instance interface{}) ([]byte, error) {
 // be sent statefully to another TLB instance.
 //
 func (store *TypeStore) FormatCapsule(instance interface{}, request_id uint16) ([]byte, error) {
-	bytes, err := bson.Marshal(instance)
+	struct_type, present := store.LookupCode(reflect.TypeOf(instance))
+	if !present {
+		return nil, errors.New("struct type missing from TypeStore")
+	}
+
+	bytes, err := store.Codec.Marshal(instance)
 	if err != nil {
 		return bytes, err
 	}
 
+	capsule := Capsule{
+		RequestID: request_id,
+		Type:      struct_type,
+		Data:      string(bytes),
+	}
+
+	return store.Format(capsule)
+}
+
+//
+// Take a struct and format it inside of a WideCapsule so it can
+// be sent statefully with a 32 bit request ID.
+//
+func (store *TypeStore) FormatWideCapsule(instance interface{}, request_id uint32) ([]byte, error) {
 	struct_type, present := store.LookupCode(reflect.TypeOf(instance))
 	if !present {
-		return bytes, errors.New("struct type missing from TypeStore")
+		return nil, errors.New("struct type missing from TypeStore")
 	}
 
-	capsule := Capsule{
+	bytes, err := store.Codec.Marshal(instance)
+	if err != nil {
+		return bytes, err
+	}
+
+	capsule := WideCapsule{
 		RequestID: request_id,
 		Type:      struct_type,
 		Data:      string(bytes),
@@ -168,9 +427,55 @@ func (store *TypeStore) FormatCapsule(instance interface{}, request_id uint16) (
 	return store.Format(capsule)
 }
 
+//
+// Take a struct and format it inside of a Reply so it can be sent
+// to a Peer in response to one of its requests.
+//
+func (store *TypeStore) FormatReply(instance interface{}, request_id uint32) ([]byte, error) {
+	struct_type, present := store.LookupCode(reflect.TypeOf(instance))
+	if !present {
+		return nil, errors.New("struct type missing from TypeStore")
+	}
+
+	bytes, err := store.Codec.Marshal(instance)
+	if err != nil {
+		return bytes, err
+	}
+
+	reply := Reply{
+		RequestID: request_id,
+		Type:      struct_type,
+		Data:      string(bytes),
+	}
+
+	return store.Format(reply)
+}
+
+//
+// An UnknownType is returned by NextStruct for a struct whose type
+// code is not in the TypeStore, or whose name was not negotiated
+// during the handshake, such as a type added to a newer version of
+// the other end.  The struct has been read from the socket, so the
+// next struct can still be read.
+//
+type UnknownType struct {
+	Code uint16
+}
+
+//
+// Error allows an UnknownType to be used as an error.
+//
+func (unknown_type *UnknownType) Error() string {
+	return "type code on received struct not in type store"
+}
+
 //
 // Read a struct from a net.Conn interface using the types contained
-// in a TypeStore.
+// in a TypeStore.  If the Builder panics the struct is discarded and
+// a *HandlerPanic is returned, and structs of unknown types are
+// skipped with an *UnknownType, both leaving the socket ready to read
+// the next struct.  Callers reading a socket directly should check
+// for these errors and keep reading instead of closing the socket.
 //
 func (store *TypeStore) NextStruct(socket net.Conn, context TLBContext) (interface{}, error) {
 	header := make([]byte, 6)
@@ -185,13 +490,10 @@ func (store *TypeStore) NextStruct(socket net.Conn, context TLBContext) (interfa
 	type_bytes := header[:2]
 	size_bytes := header[2:]
 
-	type_int := binary.LittleEndian.Uint16(type_bytes)
+	remote_code := binary.LittleEndian.Uint16(type_bytes)
+	type_int, present := context.Handshake.LocalCode(remote_code)
 	size_int := binary.LittleEndian.Uint32(size_bytes)
 
-	if _, present := store.Types[type_int]; !present {
-		return nil, errors.New("type code on received struct not in type store")
-	}
-
 	struct_data := make([]byte, 0)
 	total_read := 0
 	for total_read < int(size_int) {
@@ -208,7 +510,11 @@ func (store *TypeStore) NextStruct(socket net.Conn, context TLBContext) (interfa
 		struct_data = append(struct_data, buf[:n]...)
 	}
 
-	recieved_struct := store.BuildType(type_int, struct_data, context)
+	if _, known := store.Types[type_int]; !present || !known {
+		return nil, &UnknownType{
+			Code: remote_code,
+		}
+	}
 
-	return recieved_struct, nil
+	return store.buildType(type_int, struct_data, context)
 }
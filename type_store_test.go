@@ -2,6 +2,7 @@ package tlb_test
 
 import (
 	"encoding/binary"
+	"errors"
 	. "github.com/hkparker/TLB"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -87,6 +88,36 @@ var _ = Describe("TypeStore", func() {
 			Expect(err).ToNot(BeNil())
 		})
 
+		It("names types after their package and type name", func() {
+			err := type_store.AddType(reflect.TypeOf(Thingy{}), reflect.TypeOf(&Thingy{}), BuildThingy)
+			Expect(err).To(BeNil())
+			Expect(type_store.Names[1]).To(Equal("github.com/hkparker/TLB_test.Thingy"))
+		})
+
+		It("reports an error when a type name is reused", func() {
+			err := type_store.AddNamedType("thingy", reflect.TypeOf(Thingy{}), reflect.TypeOf(&Thingy{}), BuildThingy)
+			Expect(err).To(BeNil())
+			err = type_store.AddNamedType("thingy", reflect.TypeOf(Thingy{}), reflect.TypeOf(&Thingy{}), BuildThingy)
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("reports an error when a type is added twice", func() {
+			inst_type := reflect.TypeOf(Thingy{})
+			ptr_type := reflect.TypeOf(&Thingy{})
+			err := type_store.AddNamedType("first", inst_type, ptr_type, BuildThingy)
+			Expect(err).To(BeNil())
+			err = type_store.AddNamedType("second", inst_type, ptr_type, BuildThingy)
+			Expect(err).ToNot(BeNil())
+			Expect(type_store.NextID).To(Equal(uint16(2)))
+		})
+
+		It("panics on errors when the type store is strict", func() {
+			type_store.Strict = true
+			Expect(func() {
+				type_store.AddType(reflect.TypeOf(Thingy{}), reflect.TypeOf(&Thingy{}), nil)
+			}).To(Panic())
+		})
+
 		It("reports an error with nil builder", func() {
 			inst_type := reflect.TypeOf(Thingy{})
 			ptr_type := reflect.TypeOf(&Thingy{})
@@ -95,6 +126,49 @@ var _ = Describe("TypeStore", func() {
 		})
 	})
 
+	Describe("Register", func() {
+		It("adds the type with a builder using the codec", func() {
+			err := type_store.Register(Thingy{})
+			Expect(err).To(BeNil())
+			Expect(type_store.TypeCodes[reflect.TypeOf(Thingy{})]).To(Equal(uint16(1)))
+			Expect(type_store.TypeCodes[reflect.TypeOf(&Thingy{})]).To(Equal(uint16(1)))
+			thingy_bytes, err := bson.Marshal(thingy)
+			Expect(err).To(BeNil())
+			iface := type_store.BuildType(1, thingy_bytes, TLBContext{})
+			if restored, correct_type := iface.(*Thingy); correct_type {
+				Expect(restored.Name).To(Equal(thingy.Name))
+				Expect(restored.ID).To(Equal(thingy.ID))
+			} else {
+				Expect(correct_type).To(Equal(true))
+			}
+		})
+
+		It("accepts a pointer to the type", func() {
+			err := type_store.Register(&Thingy{})
+			Expect(err).To(BeNil())
+			Expect(type_store.Names[1]).To(Equal(TypeName(reflect.TypeOf(Thingy{}))))
+		})
+
+		It("discards structs that fail validation", func() {
+			err := type_store.Register(Thingy{}, func(iface interface{}, _ TLBContext) error {
+				if iface.(*Thingy).ID != 1 {
+					return errors.New("bad id")
+				}
+				return nil
+			})
+			Expect(err).To(BeNil())
+			valid_bytes, _ := bson.Marshal(thingy)
+			Expect(type_store.BuildType(1, valid_bytes, TLBContext{})).ToNot(BeNil())
+			invalid_bytes, _ := bson.Marshal(Thingy{ID: 2})
+			Expect(type_store.BuildType(1, invalid_bytes, TLBContext{})).To(BeNil())
+		})
+
+		It("reports an error with a nil instance", func() {
+			err := type_store.Register(nil)
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
 	Describe("LookupCode", func() {
 		It("correctly looks up codes", func() {
 			code, present := type_store.LookupCode(reflect.TypeOf(Capsule{}))
@@ -199,6 +273,25 @@ var _ = Describe("TypeStore", func() {
 		})
 	})
 
+	Describe("FormatWideCapsule", func() {
+		It("formats wide capsules correctly", func() {
+			capsule_bytes, err := populated_type_store.FormatWideCapsule(thingy, 70000)
+			Expect(err).To(BeNil())
+			type_int := binary.LittleEndian.Uint16(capsule_bytes[:2])
+			Expect(type_int).To(Equal(WideCapsuleCode))
+			restored_capsule := &WideCapsule{}
+			err = bson.Unmarshal(capsule_bytes[6:], &restored_capsule)
+			Expect(err).To(BeNil())
+			Expect(restored_capsule.RequestID).To(Equal(uint32(70000)))
+			Expect(restored_capsule.Type).To(Equal(uint16(1)))
+		})
+
+		It("returns an error when type missing from type store", func() {
+			_, err := type_store.FormatWideCapsule(thingy, 1)
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
 	Describe("NextStruct", func() {
 		It("can read multiple structs", func() {
 			sockets := make(chan net.Conn, 1)
@@ -276,6 +369,31 @@ var _ = Describe("TypeStore", func() {
 			Expect(err.Error()).To(Equal("type code on received struct not in type store"))
 		})
 
+		It("can read the next struct after one missing from the type store", func() {
+			sockets := make(chan net.Conn, 1)
+			server, err := net.Listen("tcp", "localhost:0")
+			Expect(err).To(BeNil())
+			defer server.Close()
+			go func() {
+				conn, _ := server.Accept()
+				sockets <- conn
+			}()
+			client, err := net.Dial("tcp", server.Addr().String())
+			Expect(err).To(BeNil())
+			defer client.Close()
+			server_side := <-sockets
+			thingy_bytes, _ := populated_type_store.Format(thingy)
+			capsule_bytes, _ := type_store.Format(capsule)
+			server_side.Write(thingy_bytes)
+			server_side.Write(capsule_bytes)
+			_, err = type_store.NextStruct(client, TLBContext{})
+			_, unknown := err.(*UnknownType)
+			Expect(unknown).To(Equal(true))
+			iface, err := type_store.NextStruct(client, TLBContext{})
+			Expect(err).To(BeNil())
+			Expect(iface).To(Equal(&capsule))
+		})
+
 		It("returns an error when too few bytes are written", func() {
 			sockets := make(chan net.Conn, 1)
 			server, err := net.Listen("tcp", "localhost:0")
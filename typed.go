@@ -0,0 +1,58 @@
+package tlb
+
+import (
+	"errors"
+	"reflect"
+)
+
+//
+// Return the reflect.Type of T.
+//
+func typeOf[T any]() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
+
+//
+// On is a typed form of server.Accept.  The callback receives a *T
+// instead of an interface{}, and an error is returned if T is not in
+// the server's TypeStore.
+//
+func On[T any](server *Server, socket_tag string, function func(*T, TLBContext)) error {
+	if function == nil {
+		return server.misuse(errors.New("function cannot be nil"))
+	}
+	return server.Accept(socket_tag, typeOf[T](), func(iface interface{}, context TLBContext) {
+		if received, ok := iface.(*T); ok {
+			function(received, context)
+		}
+	})
+}
+
+//
+// OnRequest is a typed form of server.AcceptRequest.  The callback
+// receives a *Req and returns the Resp to send back to the client.
+// If the callback returns an error it is sent with context.RespondError
+// instead.  An error is returned if either type is not in the server's
+// TypeStore.
+//
+func OnRequest[Req, Resp any](server *Server, socket_tag string, function func(*Req, TLBContext) (Resp, error)) error {
+	if function == nil {
+		return server.misuse(errors.New("function cannot be nil"))
+	}
+	response_type := typeOf[Resp]()
+	if _, present := server.TypeStore.LookupCode(response_type); !present {
+		return server.misuse(errors.New("type " + response_type.String() + " not in type store"))
+	}
+	return server.AcceptRequest(socket_tag, typeOf[Req](), func(iface interface{}, context TLBContext) {
+		received, ok := iface.(*Req)
+		if !ok {
+			return
+		}
+		response, err := function(received, context)
+		if err != nil {
+			context.RespondError(err)
+			return
+		}
+		context.Respond(response)
+	})
+}
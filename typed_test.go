@@ -0,0 +1,100 @@
+package tlb_test
+
+import (
+	"context"
+	. "github.com/hkparker/TLB"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net"
+	"reflect"
+	"time"
+)
+
+var _ = Describe("Typed handlers", func() {
+
+	var (
+		type_store           TypeStore
+		populated_type_store TypeStore
+		thingy               Thingy
+	)
+
+	BeforeEach(func() {
+		type_store = NewTypeStore()
+		populated_type_store = NewTypeStore()
+		populated_type_store.AddType(reflect.TypeOf(Thingy{}), reflect.TypeOf(&Thingy{}), BuildThingy)
+		populated_type_store.AddType(reflect.TypeOf(Gadget{}), reflect.TypeOf(&Gadget{}), BuildGadget)
+		thingy = Thingy{
+			Name: "test",
+			ID:   1,
+		}
+	})
+
+	Describe("On", func() {
+		It("runs the callback with the typed struct", func() {
+			listener, err := net.Listen("tcp", "localhost:0")
+			Expect(err).To(BeNil())
+			defer listener.Close()
+			server := NewServer(listener, TagSocketAll, populated_type_store)
+			names := make(chan string, 1)
+			err = On(&server, "all", func(received *Thingy, _ TLBContext) {
+				names <- received.Name
+			})
+			Expect(err).To(BeNil())
+			client_socket, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).To(BeNil())
+			defer client_socket.Close()
+			client := NewClient(client_socket, populated_type_store, false)
+			err = client.Message(thingy)
+			Expect(err).To(BeNil())
+			Expect(<-names).To(Equal("test"))
+		})
+
+		It("returns an error when the type is not in the type store", func() {
+			listener, err := net.Listen("tcp", "localhost:0")
+			Expect(err).To(BeNil())
+			defer listener.Close()
+			server := NewServer(listener, TagSocketAll, type_store)
+			err = On(&server, "all", func(_ *Thingy, _ TLBContext) {})
+			Expect(err).ToNot(BeNil())
+			Expect(server.Events["all"]).To(BeEmpty())
+		})
+	})
+
+	Describe("OnRequest", func() {
+		It("responds with the value returned by the callback", func() {
+			listener, err := net.Listen("tcp", "localhost:0")
+			Expect(err).To(BeNil())
+			defer listener.Close()
+			server := NewServer(listener, TagSocketAll, populated_type_store)
+			err = OnRequest(&server, "all", func(received *Thingy, _ TLBContext) (Gadget, error) {
+				return Gadget{Size: received.ID + 1}, nil
+			})
+			Expect(err).To(BeNil())
+			client_socket, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).To(BeNil())
+			defer client_socket.Close()
+			client := NewClient(client_socket, populated_type_store, false)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			iface, err := client.RequestContext(ctx, thingy, reflect.TypeOf(Gadget{}))
+			Expect(err).To(BeNil())
+			if response, correct_type := iface.(*Gadget); correct_type {
+				Expect(response.Size).To(Equal(2))
+			} else {
+				Expect(correct_type).To(Equal(true))
+			}
+		})
+
+		It("returns an error when the response type is not in the type store", func() {
+			listener, err := net.Listen("tcp", "localhost:0")
+			Expect(err).To(BeNil())
+			defer listener.Close()
+			server := NewServer(listener, TagSocketAll, populated_type_store)
+			err = OnRequest(&server, "all", func(_ *Thingy, _ TLBContext) (struct{}, error) {
+				return struct{}{}, nil
+			})
+			Expect(err).ToNot(BeNil())
+			Expect(server.Requests["all"]).To(BeEmpty())
+		})
+	})
+})